@@ -20,15 +20,15 @@ func main() {
 
 	go svc.Run(commands, events)
 	go func() {
-		commands <- service.Command{service.Start, responses}
+		commands <- service.Command{Name: service.Start, Response: responses}
 		time.Sleep(5 * time.Second)
-		commands <- service.Command{service.Restart, responses}
+		commands <- service.Command{Name: service.Restart, Response: responses}
 		time.Sleep(5 * time.Second)
-		commands <- service.Command{service.Stop, responses}
+		commands <- service.Command{Name: service.Stop, Response: responses}
 		time.Sleep(5 * time.Second)
-		commands <- service.Command{service.Start, responses}
+		commands <- service.Command{Name: service.Start, Response: responses}
 		time.Sleep(15 * time.Second)
-		commands <- service.Command{service.Shutdown, responses}
+		commands <- service.Command{Name: service.Shutdown, Response: responses}
 	}()
 
 loop:
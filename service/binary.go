@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// argv returns the command line of the process.
+func (s *Service) argv() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.args
+}
+
+// binaryPath returns the path to the binary the service executes.
+func (s *Service) binaryPath() (string, error) {
+	binary := s.argv()[0]
+	if strings.Contains(binary, "/") {
+		return binary, nil
+	}
+	return exec.LookPath(binary)
+}
+
+// SwapBinary replaces the binary the service executes with the one at path.
+// The new binary is used the next time the process starts, so send a Restart
+// to switch over immediately. The current binary is kept as a rollback target.
+func (s *Service) SwapBinary(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rollback = s.args[0]
+	s.args = append([]string{path}, s.args[1:]...)
+	return nil
+}
+
+// Rollback reverts the binary replaced by the last call to SwapBinary and
+// restarts a Running process so that it runs the previous binary again.
+// Otherwise the previous binary is used the next time the process starts.
+func (s *Service) Rollback() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rollback == "" {
+		return errors.New("no binary to roll back to")
+	}
+	s.args = append([]string{s.rollback}, s.args[1:]...)
+	s.rollback = ""
+	if s.rolledBack != nil {
+		select {
+		case s.rolledBack <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// binarySum returns a checksum of the file at path and whether it is executable.
+func binarySum(path string) ([]byte, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, false, err
+	}
+	return hash.Sum(nil), info.Mode()&0111 != 0, nil
+}
+
+// ErrUnstableBinary is the error of a start which gave up waiting for the
+// binary to become stable within BinaryStableTimeout.
+var ErrUnstableBinary = errors.New("binary did not become stable")
+
+// waitStable blocks until the service binary is executable and its checksum
+// has not changed for BinaryStable. This avoids starting a binary which is
+// still being written by a deploy. If the binary cannot be read the wait is
+// abandoned and the start is left to fail on its own. It fails with
+// ErrUnstableBinary if the binary is still changing or not executable after
+// BinaryStableTimeout. The settings are taken from cfg.
+func (s *Service) waitStable(cfg *settings) error {
+	if cfg.binaryStable <= 0 {
+		return nil
+	}
+	timeout := cfg.binaryStableTimeout
+	if timeout <= 0 {
+		timeout = DefaultBinaryStableTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	path, err := s.binaryPath()
+	if err != nil {
+		return nil
+	}
+
+	last, _, err := binarySum(path)
+	if err != nil {
+		return nil
+	}
+	for {
+		if time.Now().Add(cfg.binaryStable).After(deadline) {
+			return fmt.Errorf("%w: %s after %s", ErrUnstableBinary, path, timeout)
+		}
+		time.Sleep(cfg.binaryStable)
+		sum, executable, err := binarySum(path)
+		if err != nil {
+			return nil
+		}
+		if executable && bytes.Equal(sum, last) {
+			return nil
+		}
+		last = sum
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, _ := NewService([]string{path})
+	svc.BinaryStable = 100 * time.Millisecond
+
+	// Simulate a deploy which writes the binary in chunks and marks it
+	// executable once complete.
+	written := make(chan time.Time, 1)
+	go func() {
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			file.WriteString("sleep 1\n")
+		}
+		file.Close()
+		os.Chmod(path, 0755)
+		written <- time.Now()
+	}()
+
+	if err := svc.waitStable(svc.snapshot()); err != nil {
+		t.Errorf("svc.waitStable() => error{%s}, wanted nil", err)
+	}
+	done := time.Now()
+	finished := <-written
+	if done.Before(finished.Add(svc.BinaryStable / 2)) {
+		t.Errorf("waitStable returned %s after the last write, wanted about %s", done.Sub(finished), svc.BinaryStable)
+	}
+}
+
+func TestWaitStableMissing(t *testing.T) {
+	svc, _ := NewService([]string{filepath.Join(t.TempDir(), "missing")})
+	svc.BinaryStable = time.Hour
+
+	done := make(chan bool)
+	go func() {
+		svc.waitStable(svc.snapshot())
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("waitStable blocked on a missing binary")
+	}
+}
+
+func TestWaitStableTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, _ := NewService([]string{path})
+	svc.StartRetries = 0
+	svc.BinaryStable = 20 * time.Millisecond
+	svc.BinaryStableTimeout = 100 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	fatal := h.expect(Starting, Fatal)[1]
+	if !errors.Is(fatal.Error, ErrUnstableBinary) {
+		t.Errorf("event.Error => %v, wanted ErrUnstableBinary", fatal.Error)
+	}
+	h.response()
+}
+
+func TestSwapBinary(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := func(name string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte("#!/bin/sh\necho "+name+" >> "+log+"\nexec sleep 10\n"), 0755)
+		return path
+	}
+	blue, green := script("blue"), script("green")
+	lastRun := func() string {
+		data, _ := os.ReadFile(log)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		return lines[len(lines)-1]
+	}
+
+	svc, _ := NewService([]string{blue})
+	svc.StartTimeout = 100 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	if name := lastRun(); name != "blue" {
+		t.Errorf("running %s, wanted blue", name)
+	}
+
+	if err := svc.SwapBinary(filepath.Join(dir, "log")); err == nil {
+		t.Errorf("svc.SwapBinary(log) => nil, wanted error for a non-executable file")
+	}
+	if err := svc.SwapBinary(green); err != nil {
+		t.Fatalf("svc.SwapBinary(green) => error{%s}, wanted nil", err)
+	}
+	h.send(Restart)
+	h.expect(Stopping, Stopped, Starting, Running)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Success() => false, wanted true, error{%s}", response.Error)
+	}
+	if name := lastRun(); name != "green" {
+		t.Errorf("running %s after swap, wanted green", name)
+	}
+
+	if err := svc.Rollback(); err != nil {
+		t.Fatalf("svc.Rollback() => error{%s}, wanted nil", err)
+	}
+	h.expect(Stopping, Stopped, Starting, Running)
+	if name := lastRun(); name != "blue" {
+		t.Errorf("running %s after rollback, wanted blue", name)
+	}
+	if err := svc.Rollback(); err == nil {
+		t.Errorf("svc.Rollback() => nil, wanted error with nothing to roll back to")
+	}
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRestartBudget is the error of the Fatal event sent when a RestartBudget
+// with FatalWhenEmpty set, or without an Interval, runs out.
+var ErrRestartBudget = errors.New("restart budget exhausted")
+
+// RestartBudget limits automatic restarts with a token bucket. Each restart
+// after an exit, a backoff or a FatalCooldown takes a token, and a token is added
+// every Interval up to Burst. When the budget is empty the restart is held
+// until a token is added, or the service goes Fatal if FatalWhenEmpty is set.
+// A budget without an Interval is never refilled, so it goes Fatal once empty.
+// Restarts requested with commands are not limited.
+type RestartBudget struct {
+	Interval       time.Duration // How often a token is added, or never if zero.
+	Burst          int           // The maximum number of tokens. The budget starts full.
+	FatalWhenEmpty bool          // Whether to go Fatal rather than wait when there are no tokens.
+	tokens         float64       // The number of tokens in the bucket.
+	last           time.Time     // When tokens was last refilled.
+	started        bool          // Whether the bucket has been filled initially.
+	mutex          sync.Mutex
+}
+
+// refill adds the tokens accumulated since the last refill. Must be called
+// with mutex held.
+func (b *RestartBudget) refill() {
+	now := time.Now()
+	if !b.started {
+		b.tokens = float64(b.Burst)
+		b.started = true
+	} else if b.Interval > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.Interval)
+		if b.tokens > float64(b.Burst) {
+			b.tokens = float64(b.Burst)
+		}
+	}
+	b.last = now
+}
+
+// Remaining returns the number of restarts that may be made without waiting.
+func (b *RestartBudget) Remaining() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	return int(b.tokens)
+}
+
+// take removes a token and returns true, or returns false if there are none.
+func (b *RestartBudget) take() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// fatal returns true if the service goes Fatal when the budget is empty
+// rather than waiting for a token which may never come.
+func (b *RestartBudget) fatal() bool {
+	return b.FatalWhenEmpty || b.Interval <= 0
+}
+
+// wait returns how long until the next token is added.
+func (b *RestartBudget) wait() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	return time.Duration((1 - b.tokens) * float64(b.Interval))
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartBudget(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runners := []*fakeRunner{newFakeRunner(100), newFakeRunner(101), newFakeRunner(102), newFakeRunner(103)}
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.RestartBudget = &RestartBudget{Interval: 200 * time.Millisecond, Burst: 2}
+	svc.CommandFactory = fakeFactory(runners...)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	for i, runner := range runners[:3] {
+		crashed := time.Now()
+		runner.Exit(failure)
+		h.expect(Exited, Starting, Running)
+		elapsed := time.Since(crashed)
+		if i < 2 && elapsed >= 150*time.Millisecond {
+			t.Errorf("restart %d took %s, wanted it within the burst", i+1, elapsed)
+		} else if i == 2 && elapsed < 150*time.Millisecond {
+			t.Errorf("restart %d took %s, wanted it to wait for a token", i+1, elapsed)
+		}
+	}
+	if remaining := svc.RestartBudget.Remaining(); remaining != 0 {
+		t.Errorf("svc.RestartBudget.Remaining() => %d, wanted 0", remaining)
+	}
+}
+
+func TestRestartBudgetFatal(t *testing.T) {
+	failure := errors.New("exit status 1")
+	crash := newFakeRunner(100)
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.RestartBudget = &RestartBudget{Interval: time.Hour, Burst: 0, FatalWhenEmpty: true}
+	svc.CommandFactory = fakeFactory(crash)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	crash.Exit(failure)
+	events := h.expect(Exited, Fatal)
+	if !errors.Is(events[1].Error, ErrRestartBudget) {
+		t.Errorf("event.Error => %v, wanted %v", events[1].Error, ErrRestartBudget)
+	}
+}
+
+func TestRestartBudgetNoInterval(t *testing.T) {
+	failure := errors.New("exit status 1")
+	crash := newFakeRunner(100)
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.RestartBudget = &RestartBudget{Burst: 0}
+	svc.CommandFactory = fakeFactory(crash)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// The budget is never refilled, so waiting for it would spin.
+	crash.Exit(failure)
+	events := h.expect(Exited, Fatal)
+	if !errors.Is(events[1].Error, ErrRestartBudget) {
+		t.Errorf("event.Error => %v, wanted %v", events[1].Error, ErrRestartBudget)
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"syscall"
+	"time"
+)
+
+// settings is a snapshot of the settings Run uses to start, watch and stop
+// the process. Run takes one under the config lock as each start, stop or
+// handover begins and uses only the snapshot until the next, so Configure may
+// change the fields of the Service at any time.
+type settings struct {
+	logger                  *slog.Logger
+	metrics                 Metrics
+	labels                  map[string]string
+	startTimeout            time.Duration
+	startTimeoutAtLaunch    bool
+	startRetries            int
+	readinessProbe          Probe
+	readinessInterval       time.Duration
+	readinessEvents         bool
+	handoverSignal          syscall.Signal
+	handoverProbe           Probe
+	maxBackoffTime          time.Duration
+	healthyAfter            time.Duration
+	backoffInitial          time.Duration
+	backoffMax              time.Duration
+	backoffFactor           float64
+	backoffFloor            time.Duration
+	reloadSignal            syscall.Signal
+	stopSteps               []StopStep
+	stopTimeout             time.Duration
+	stopWarnAfter           time.Duration
+	killSignal              syscall.Signal
+	processGroup            bool
+	credential              *Credential
+	closeOnExec             bool
+	restartPolicy           RestartPolicy
+	shouldRestart           RestartFunc
+	restartOnOutputDebounce time.Duration
+	commandFactory          func(args []string) Runner
+	drainProbe              func(*Service) error
+	drainTimeout            time.Duration
+	drainInterval           time.Duration
+	onForceKill             func(pid int)
+	onOutputFallback        func(err error)
+	onStdinError            func(err error)
+	binaryStable            time.Duration
+	binaryStableTimeout     time.Duration
+	fatalCooldown           time.Duration
+	pidFile                 string
+	orphans                 OrphanPolicy
+	processTitle            string
+	restartBudget           *RestartBudget
+	restartSchedule         string
+}
+
+// snapshot returns the current settings of the service.
+func (s *Service) snapshot() *settings {
+	s.config.Lock()
+	defer s.config.Unlock()
+
+	steps := []StopStep{{s.StopSignal, s.StopTimeout}}
+	if len(s.StopSignals) > 0 {
+		steps = append([]StopStep(nil), s.StopSignals...)
+	}
+	policy := s.RestartPolicy
+	if policy == "" && s.StopRestart {
+		policy = RestartAlways
+	} else if policy == "" {
+		policy = RestartNever
+	}
+	return &settings{
+		logger:                  s.Logger,
+		metrics:                 s.Metrics,
+		labels:                  s.Labels,
+		startTimeout:            s.StartTimeout,
+		startTimeoutAtLaunch:    s.StartTimeoutAtLaunch,
+		startRetries:            s.StartRetries,
+		readinessProbe:          s.ReadinessProbe,
+		readinessInterval:       s.ReadinessInterval,
+		readinessEvents:         s.ReadinessEvents,
+		handoverSignal:          s.HandoverSignal,
+		handoverProbe:           s.HandoverProbe,
+		maxBackoffTime:          s.MaxBackoffTime,
+		healthyAfter:            s.HealthyAfter,
+		backoffInitial:          s.BackoffInitial,
+		backoffMax:              s.BackoffMax,
+		backoffFactor:           s.BackoffFactor,
+		backoffFloor:            s.BackoffFloor,
+		reloadSignal:            s.ReloadSignal,
+		stopSteps:               steps,
+		stopTimeout:             s.StopTimeout,
+		stopWarnAfter:           s.StopWarnAfter,
+		killSignal:              s.KillSignal,
+		processGroup:            s.ProcessGroup,
+		credential:              s.Credential,
+		closeOnExec:             s.CloseOnExec,
+		restartPolicy:           policy,
+		shouldRestart:           s.ShouldRestart,
+		restartOnOutputDebounce: s.RestartOnOutputDebounce,
+		commandFactory:          s.CommandFactory,
+		drainProbe:              s.DrainProbe,
+		drainTimeout:            s.DrainTimeout,
+		drainInterval:           s.DrainInterval,
+		onForceKill:             s.OnForceKill,
+		onOutputFallback:        s.OnOutputFallback,
+		onStdinError:            s.OnStdinError,
+		binaryStable:            s.BinaryStable,
+		binaryStableTimeout:     s.BinaryStableTimeout,
+		fatalCooldown:           s.FatalCooldown,
+		pidFile:                 s.PidFile,
+		orphans:                 s.Orphans,
+		processTitle:            s.ProcessTitle,
+		restartBudget:           s.RestartBudget,
+		restartSchedule:         s.RestartSchedule,
+	}
+}
+
+// backoff returns how long to wait before the next start attempt after the
+// given number of retries. The delay saturates at BackoffMax, or at the
+// longest possible duration, rather than overflowing.
+func (c *settings) backoff(retries int) time.Duration {
+	limit := c.backoffMax
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	delay := limit
+	growth := float64(c.backoffInitial) * math.Pow(c.backoffFactor, float64(retries))
+	if math.IsNaN(growth) || growth <= 0 {
+		delay = 0
+	} else if growth < float64(limit) {
+		delay = time.Duration(growth)
+	}
+
+	floor := c.backoffFloor
+	if floor < 0 {
+		floor = 0
+	}
+	if delay > math.MaxInt64-floor {
+		return math.MaxInt64
+	}
+	return floor + delay
+}
+
+// reload returns ReloadSignal, failing if it is unset or is also one of the
+// signals sent to stop the process.
+func (c *settings) reload() (syscall.Signal, error) {
+	if c.reloadSignal == 0 {
+		return 0, errors.New("reload signal is not set")
+	}
+	for _, step := range c.stopSteps {
+		if step.Signal == c.reloadSignal {
+			return 0, fmt.Errorf("reload signal %s is also a stop signal", c.reloadSignal)
+		}
+	}
+	return c.reloadSignal, nil
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultSanitizeDeny lists the variables removed from the environment of a
+// service with SanitizeEnv set. These variables alter how the dynamic linker
+// or shell behave and are a common vector for injecting code into a process.
+var DefaultSanitizeDeny = []string{
+	"LD_PRELOAD",
+	"LD_LIBRARY_PATH",
+	"LD_AUDIT",
+	"LD_DEBUG",
+	"DYLD_INSERT_LIBRARIES",
+	"DYLD_LIBRARY_PATH",
+	"IFS",
+	"ENV",
+	"BASH_ENV",
+}
+
+// environment returns the environment to start the process with.
+func (s *Service) environment() []string {
+	env := s.Environment
+	if s.InheritEnvironment && env != nil {
+		env = mergeEnv(os.Environ(), env)
+	}
+	if !s.SanitizeEnv {
+		return env
+	}
+
+	if env == nil {
+		env = os.Environ()
+	}
+
+	deny := make(map[string]bool, len(s.SanitizeDeny)+1)
+	for _, name := range s.SanitizeDeny {
+		deny[name] = true
+	}
+	if s.SanitizePath != "" {
+		deny["PATH"] = true
+	}
+
+	sanitized := make([]string, 0, len(env)+1)
+	for _, entry := range env {
+		if !deny[envName(entry)] {
+			sanitized = append(sanitized, entry)
+		}
+	}
+	if s.SanitizePath != "" {
+		sanitized = append(sanitized, "PATH="+s.SanitizePath)
+	}
+	return sanitized
+}
+
+// envName returns the name portion of a NAME=value environment entry.
+func envName(entry string) string {
+	if i := strings.Index(entry, "="); i >= 0 {
+		return entry[:i]
+	}
+	return entry
+}
+
+// mergeEnv combines environments, keeping one entry per variable name. A later
+// entry replaces the value of an earlier one but keeps its position.
+func mergeEnv(envs ...[]string) []string {
+	merged := []string{}
+	index := make(map[string]int)
+	for _, env := range envs {
+		for _, entry := range env {
+			name := envName(entry)
+			if i, ok := index[name]; ok {
+				merged[i] = entry
+			} else {
+				index[name] = len(merged)
+				merged = append(merged, entry)
+			}
+		}
+	}
+	return merged
+}
+
+// expandEnv expands $VAR and ${VAR} references in args and in the values of
+// env using the variables in env, or in the current environment if env is nil.
+// Unknown variables expand to the empty string unless strict is set, in which
+// case an error naming the first one is returned.
+func expandEnv(args, env []string, strict bool) ([]string, []string, error) {
+	vars := make(map[string]string)
+	lookup := env
+	if lookup == nil {
+		lookup = os.Environ()
+	}
+	for _, entry := range lookup {
+		name := envName(entry)
+		vars[name] = strings.TrimPrefix(entry[len(name):], "=")
+	}
+
+	var missing string
+	expand := func(value string) string {
+		return os.Expand(value, func(name string) string {
+			value, ok := vars[name]
+			if !ok && missing == "" {
+				missing = name
+			}
+			return value
+		})
+	}
+
+	expandedArgs := make([]string, len(args))
+	for i, arg := range args {
+		expandedArgs[i] = expand(arg)
+	}
+	var expandedEnv []string
+	if env != nil {
+		expandedEnv = make([]string, len(env))
+		for i, entry := range env {
+			name := envName(entry)
+			if len(name) < len(entry) {
+				entry = name + "=" + expand(entry[len(name)+1:])
+			}
+			expandedEnv[i] = entry
+		}
+	}
+	if strict && missing != "" {
+		return nil, nil, fmt.Errorf("environment variable %s is not set", missing)
+	}
+	return expandedArgs, expandedEnv, nil
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeEnv(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	svc, _ := NewService([]string{"sh", "-c", "env; sleep 0.3"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = stdout
+	svc.Environment = []string{
+		"LD_PRELOAD=/tmp/evil.so",
+		"LD_LIBRARY_PATH=/tmp",
+		"IFS=x",
+		"PATH=/tmp/evil",
+		"KEEP=1",
+	}
+	svc.SanitizeEnv = true
+	svc.SanitizePath = "/usr/bin:/bin"
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+	h.shutdown()
+
+	env := map[string]string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			env[line[:i]] = line[i+1:]
+		}
+	}
+	for _, name := range []string{"LD_PRELOAD", "LD_LIBRARY_PATH", "IFS"} {
+		if value, ok := env[name]; ok {
+			t.Errorf("child environment contains %s=%s, wanted it removed", name, value)
+		}
+	}
+	if env["PATH"] != svc.SanitizePath {
+		t.Errorf("child PATH => %s, wanted %s", env["PATH"], svc.SanitizePath)
+	}
+	if env["KEEP"] != "1" {
+		t.Errorf("child KEEP => %s, wanted 1", env["KEEP"])
+	}
+}
+
+func TestInheritEnvironment(t *testing.T) {
+	t.Setenv("PARENT", "1")
+	t.Setenv("OVERRIDE", "old")
+
+	tests := []struct {
+		inherit bool
+		env     []string
+		want    map[string]string
+	}{
+		{true, []string{"OVERRIDE=new", "ADDED=1", "ADDED=2"}, map[string]string{"PARENT": "1", "OVERRIDE": "new", "ADDED": "2"}},
+		{false, []string{"OVERRIDE=new", "ADDED=1"}, map[string]string{"OVERRIDE": "new", "ADDED": "1"}},
+	}
+	for _, test := range tests {
+		svc, _ := NewService([]string{"true"})
+		svc.Environment = test.env
+		svc.InheritEnvironment = test.inherit
+
+		env := map[string]string{}
+		for _, entry := range svc.environment() {
+			name := envName(entry)
+			if _, ok := env[name]; ok {
+				t.Errorf("InheritEnvironment=%t: %s appears more than once", test.inherit, name)
+			}
+			env[name] = strings.TrimPrefix(entry, name+"=")
+		}
+		if !test.inherit && len(env) != len(test.want) {
+			t.Errorf("InheritEnvironment=%t: environment => %v, wanted only %v", test.inherit, env, test.want)
+		}
+		for name, value := range test.want {
+			if env[name] != value {
+				t.Errorf("InheritEnvironment=%t: %s => %q, wanted %q", test.inherit, name, env[name], value)
+			}
+		}
+	}
+}
+
+func TestExpandEnvironment(t *testing.T) {
+	t.Setenv("PORT", "8080")
+
+	svc, _ := NewService([]string{"server", "--port=${PORT}", "--host=$HOST"})
+	svc.Environment = []string{"ADDR=localhost:$PORT", "EMPTY=${MISSING}"}
+	svc.ExpandEnvironment = true
+
+	cmd, err := svc.makeCommand(svc.snapshot())
+	if err != nil {
+		t.Fatalf("makeCommand() => %s, wanted nil", err)
+	}
+	wantArgs := []string{"server", "--port=8080", "--host="}
+	if !reflect.DeepEqual(cmd.Args, wantArgs) {
+		t.Errorf("args => %q, wanted %q", cmd.Args, wantArgs)
+	}
+	env := strings.Join(cmd.Env, "\n")
+	for _, entry := range []string{"ADDR=localhost:8080", "EMPTY="} {
+		if !strings.Contains("\n"+env+"\n", "\n"+entry+"\n") {
+			t.Errorf("environment is missing %s", entry)
+		}
+	}
+
+	t.Setenv("PORT", "9090")
+	if cmd, _ = svc.makeCommand(svc.snapshot()); cmd.Args[1] != "--port=9090" {
+		t.Errorf("args[1] after changing PORT => %q, wanted %q", cmd.Args[1], "--port=9090")
+	}
+}
+
+func TestStrictExpand(t *testing.T) {
+	svc, _ := NewService([]string{"server", "--port=${UNSET_PORT}"})
+	svc.ExpandEnvironment = true
+	svc.StrictExpand = true
+
+	if _, err := svc.makeCommand(svc.snapshot()); err == nil || !strings.Contains(err.Error(), "UNSET_PORT") {
+		t.Errorf("makeCommand() => %v, wanted an error naming UNSET_PORT", err)
+	}
+
+	svc.Environment = []string{"UNSET_PORT=8080"}
+	cmd, err := svc.makeCommand(svc.snapshot())
+	if err != nil {
+		t.Fatalf("makeCommand() with UNSET_PORT set => %s, wanted nil", err)
+	}
+	if cmd.Args[1] != "--port=8080" {
+		t.Errorf("args[1] => %q, wanted %q", cmd.Args[1], "--port=8080")
+	}
+}
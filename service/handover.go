@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// waitHandover waits up to timeout for the process to complete a handover by
+// polling the HandoverProbe of cfg, or ReadinessProbe if it is not set, every
+// ReadinessInterval. The probe's context expires with the timeout. Without
+// either probe it waits the full timeout. It returns the probe's last error if
+// the handover did not complete.
+//
+// A handover is done nginx style. On HandoverSignal the process must start a
+// new generation of itself with the listening sockets, for example by
+// re-executing itself, and let the old one drain and exit. The process the
+// service started must keep running throughout: if it exits the Restart fails
+// and the exit is handled like any other. The probe must succeed only once the
+// new generation is serving, for example by checking a generation number. The
+// Restart succeeds once the probe does, or after the timeout without a probe,
+// and fails otherwise. The process is left running either way, no events are
+// sent, and the Restart is counted in CommandRestarts.
+func (s *Service) waitHandover(cfg *settings, timeout time.Duration) error {
+	probe := cfg.handoverProbe
+	if probe == nil {
+		probe = cfg.readinessProbe
+	}
+	if probe == nil {
+		time.Sleep(timeout)
+		return nil
+	}
+	interval := cfg.readinessInterval
+	if interval <= 0 {
+		interval = DefaultReadinessInterval
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for {
+		err := probe(ctx, s)
+		if err == nil {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if remaining > interval {
+			remaining = interval
+		}
+		time.Sleep(remaining)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build unix
+
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandover(t *testing.T) {
+	// The toy server starts generation 1 and, on USR2, "forks" the next
+	// generation by recording it once it would be serving.
+	generation := filepath.Join(t.TempDir(), "generation")
+	script := `gen=1; echo $gen > ` + generation + `
+trap 'gen=$((gen+1)); sleep 0.1; echo $gen > ` + generation + `' USR2
+while :; do sleep 0.02; done`
+
+	svc, _ := NewService([]string{"sh", "-c", script})
+	svc.StartTimeout = 500 * time.Millisecond
+	svc.ReadinessInterval = 10 * time.Millisecond
+	svc.HandoverSignal = syscall.SIGUSR2
+	want := "1\n"
+	svc.ReadinessProbe = func(context.Context, *Service) error {
+		data, err := os.ReadFile(generation)
+		if err != nil {
+			return err
+		}
+		if string(data) != want {
+			return errors.New("generation " + string(data) + " is serving")
+		}
+		return nil
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := svc.Pid()
+
+	want = "2\n"
+	h.send(Restart)
+	if response := h.response(); response.Name != Restart || !response.Success() {
+		t.Errorf("response => %s error{%v}, wanted successful %s", response.Name, response.Error, Restart)
+	}
+	if data, _ := os.ReadFile(generation); string(data) != want {
+		t.Errorf("generation => %q after handover, wanted %q", data, want)
+	}
+	if svc.Pid() != pid {
+		t.Errorf("svc.Pid() => %d after handover, wanted %d", svc.Pid(), pid)
+	}
+	if restarts := svc.CommandRestarts(); restarts != 1 {
+		t.Errorf("svc.CommandRestarts() => %d after handover, wanted 1", restarts)
+	}
+	select {
+	case event := <-h.events:
+		t.Errorf("got %s event during handover, wanted none", event.State)
+	default:
+	}
+
+	// A handover which never completes fails the Restart but leaves the
+	// process running.
+	want = "never\n"
+	svc.StartTimeout = 200 * time.Millisecond
+	h.send(Restart)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the handover to fail")
+	}
+	if svc.State() != Running || svc.Pid() != pid {
+		t.Errorf("service is %s with PID %d, wanted %s with PID %d", svc.State(), svc.Pid(), Running, pid)
+	}
+	if restarts := svc.CommandRestarts(); restarts != 1 {
+		t.Errorf("svc.CommandRestarts() => %d after a failed handover, wanted 1", restarts)
+	}
+}
+
+func TestHandoverZeroInterval(t *testing.T) {
+	runner := newFakeRunner(100)
+	runner.immune = true
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 300 * time.Millisecond
+	svc.HandoverSignal = syscall.SIGUSR2
+	svc.CommandFactory = fakeFactory(runner)
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// A zero interval polls at DefaultReadinessInterval rather than spinning.
+	probes := 0
+	svc.Configure(func(svc *Service) {
+		svc.ReadinessInterval = 0
+		svc.HandoverProbe = func(context.Context, *Service) error {
+			probes++
+			return errors.New("not handed over")
+		}
+	})
+	h.send(Restart)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the handover to fail")
+	}
+	if probes > 10 {
+		t.Errorf("probe called %d times in %s, wanted the default interval between calls", probes, svc.StartTimeout)
+	}
+	runner.immune = false
+	h.shutdown()
+}
+
+func TestHandoverDefersScheduledRestart(t *testing.T) {
+	runner := newFakeRunner(100)
+	runner.immune = true
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 500 * time.Millisecond
+	svc.HandoverSignal = syscall.SIGUSR2
+	svc.HandoverProbe = func(context.Context, *Service) error {
+		return errors.New("not handed over")
+	}
+	svc.RestartSchedule = "@every 200ms"
+	svc.CommandFactory = fakeFactory(runner, newFakeRunner(101))
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// The scheduled restart comes due during the handover and waits for it
+	// to fail rather than being dropped.
+	h.send(Restart)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the handover to fail")
+	}
+	if stopping := h.expect(Stopping)[0]; stopping.Error == nil {
+		t.Errorf("event.Error => nil, wanted the scheduled restart")
+	}
+	runner.Exit(nil)
+	h.expect(Stopped, Starting, Running)
+}
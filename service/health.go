@@ -0,0 +1,35 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Health is the JSON body written by a HealthHandler.
+type Health struct {
+	State State `json:"state"`
+	Pid   int   `json:"pid,omitempty"`
+}
+
+// HealthHandler returns an http.Handler reporting the health of svc, suitable
+// for mounting at /healthz for load balancer checks. It responds with 200 OK
+// while the service is Running and 503 Service Unavailable otherwise.
+func HealthHandler(svc *Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		health := Health{svc.State(), svc.Pid()}
+		status := http.StatusOK
+		if health.State != Running {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	handler := HealthHandler(svc)
+
+	check := func(status int, state State) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		if recorder.Code != status {
+			t.Errorf("GET /healthz => %d, wanted %d", recorder.Code, status)
+		}
+		var health Health
+		if err := json.NewDecoder(recorder.Body).Decode(&health); err != nil {
+			t.Fatalf("decoding health: %s", err)
+		}
+		if health.State != state {
+			t.Errorf("health.State => %s, wanted %s", health.State, state)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, Stopped)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	check(http.StatusOK, Running)
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	check(http.StatusServiceUnavailable, Stopped)
+}
@@ -0,0 +1,14 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+)
+
+// log logs a record to Logger if it is set.
+func (c *settings) log(level slog.Level, msg string, args ...any) {
+	if c.logger == nil {
+		return
+	}
+	c.logger.Log(context.Background(), level, msg, args...)
+}
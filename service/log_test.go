@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureHandler is a slog.Handler which keeps the records it handles.
+type captureHandler struct {
+	records []slog.Record
+	mutex   sync.Mutex
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, record)
+	return nil
+}
+
+// find returns the attributes of the records with the given message.
+func (h *captureHandler) find(msg string) []map[string]string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var found []map[string]string
+	for _, record := range h.records {
+		if record.Message != msg {
+			continue
+		}
+		attrs := map[string]string{"level": record.Level.String()}
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs[attr.Key] = attr.Value.String()
+			return true
+		})
+		found = append(found, attrs)
+	}
+	return found
+}
+
+func TestLogger(t *testing.T) {
+	handler := &captureHandler{}
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.Logger = slog.New(handler)
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.shutdown()
+
+	transitions := handler.find("state transition")
+	if len(transitions) < 2 {
+		t.Fatalf("logged %d state transitions, wanted at least 2", len(transitions))
+	}
+	for i, want := range []map[string]string{
+		{"level": "INFO", "from": "stopped", "to": "starting"},
+		{"level": "INFO", "from": "starting", "to": "running"},
+	} {
+		for key, value := range want {
+			if transitions[i][key] != value {
+				t.Errorf("state transition %d %s => %q, wanted %q", i, key, transitions[i][key], value)
+			}
+		}
+	}
+	if started := handler.find("process started"); len(started) != 1 || started[0]["pid"] == "" {
+		t.Errorf("process started records => %v, wanted one with the pid", started)
+	}
+	// The stop goroutine logs the signal after sending it, which may be after
+	// Run has seen the process exit.
+	signaled := handler.find("signaled process")
+	for deadline := time.Now().Add(time.Second); len(signaled) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		signaled = handler.find("signaled process")
+	}
+	if len(signaled) != 1 || signaled[0]["signal"] != "interrupt" {
+		t.Errorf("signaled process records => %v, wanted one for interrupt", signaled)
+	}
+}
+
+func TestLoggerStartFailure(t *testing.T) {
+	handler := &captureHandler{}
+	svc, _ := NewService([]string{"/nonexistent/server"})
+	svc.StopRestart = false
+	svc.Logger = slog.New(handler)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Exited)
+	h.response()
+	if failed := handler.find("process failed to start"); len(failed) != 1 || failed[0]["level"] != "ERROR" {
+		t.Errorf("process failed to start records => %v, wanted one at ERROR", failed)
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import "time"
+
+// Metrics receives measurements of a Service so that they can be exported to
+// a monitoring system such as Prometheus. The package does not depend on any
+// particular system; the caller implements Metrics, typically with one gauge
+// per state, counters for restarts and start failures, and a gauge for the
+// process start time from which uptime is derived. The service's Labels are
+// available as svc.Labels. Methods are called from the service's Run
+// goroutine and must not block.
+type Metrics interface {
+	// SetState is called whenever the service enters a state. Implementations
+	// usually set the gauge of state to 1 and those of the other states to 0.
+	SetState(svc *Service, state State)
+
+	// AddRestart is called whenever the process is restarted, once the new
+	// process is Starting or a handover completes. commanded is true if it
+	// was restarted by a Restart command rather than after it exited.
+	AddRestart(svc *Service, commanded bool)
+
+	// AddStartFailure is called once for each start of the process which
+	// fails or exits before it is Running.
+	AddStartFailure(svc *Service)
+
+	// SetStartTime is called when the process enters Running with the time it
+	// did, and when it is no longer running with the zero time. Uptime is the
+	// time since the start time.
+	SetStartTime(svc *Service, t time.Time)
+}
+
+// updateMetrics reports the state the service entered to metrics if it is
+// set. Must be called after the state is changed.
+func (s *Service) updateMetrics(metrics Metrics, state State) {
+	if metrics == nil {
+		return
+	}
+	metrics.SetState(s, state)
+	switch state {
+	case Running:
+		metrics.SetStartTime(s, s.StartedAt())
+	case Stopped, Exited, Backoff, Fatal:
+		metrics.SetStartTime(s, time.Time{})
+	}
+}
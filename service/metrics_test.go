@@ -0,0 +1,169 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRegistry implements Metrics by keeping Prometheus style series keyed by
+// metric name and labels.
+type testRegistry struct {
+	series map[string]float64
+	mutex  sync.Mutex
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{series: make(map[string]float64)}
+}
+
+// key formats a series as name{label="value",...} with the labels sorted.
+func (r *testRegistry) key(name string, labels map[string]string, extra ...string) string {
+	var pairs []string
+	for label, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *testRegistry) SetState(svc *Service, state State) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, s := range []State{Stopped, Starting, Running, Stopping, Exited, Backoff, Fatal} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		r.series[r.key("service_state", svc.Labels, "state", string(s))] = value
+	}
+}
+
+func (r *testRegistry) AddRestart(svc *Service, commanded bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.series[r.key("service_restarts_total", svc.Labels, "commanded", fmt.Sprint(commanded))]++
+}
+
+func (r *testRegistry) AddStartFailure(svc *Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.series[r.key("service_start_failures_total", svc.Labels)]++
+}
+
+func (r *testRegistry) SetStartTime(svc *Service, t time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	value := 0.0
+	if !t.IsZero() {
+		value = float64(t.UnixNano()) / 1e9
+	}
+	r.series[r.key("service_start_time_seconds", svc.Labels)] = value
+}
+
+// scrape gets the value of a series.
+func (r *testRegistry) scrape(key string) float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.series[key]
+}
+
+func TestMetrics(t *testing.T) {
+	crash := errors.New("exit status 1")
+	runners := []*fakeRunner{newFakeRunner(100), newFakeRunner(101), newFakeRunner(102)}
+	runners[1].Exit(crash)
+	registry := newTestRegistry()
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = 10 * time.Millisecond
+	svc.CommandFactory = fakeFactory(runners...)
+	svc.Labels = map[string]string{"env": "test"}
+	svc.Metrics = registry
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	runners[0].Exit(crash)
+	h.expect(Exited, Starting, Backoff, Starting, Running)
+
+	for key, want := range map[string]float64{
+		`service_state{env="test",state="running"}`:            1,
+		`service_state{env="test",state="backoff"}`:            0,
+		`service_state{env="test",state="exited"}`:             0,
+		`service_restarts_total{commanded="false",env="test"}`: 2,
+		`service_restarts_total{commanded="true",env="test"}`:  0,
+		`service_start_failures_total{env="test"}`:             1,
+		`service_start_time_seconds{env="test"}`:               float64(svc.StartedAt().UnixNano()) / 1e9,
+	} {
+		if value := registry.scrape(key); value != want {
+			t.Errorf("%s => %v, wanted %v", key, value, want)
+		}
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	for key, want := range map[string]float64{
+		`service_state{env="test",state="running"}`: 0,
+		`service_state{env="test",state="stopped"}`: 1,
+		`service_start_time_seconds{env="test"}`:    0,
+	} {
+		if value := registry.scrape(key); value != want {
+			t.Errorf("%s => %v, wanted %v", key, value, want)
+		}
+	}
+}
+
+func TestMetricsNotCounted(t *testing.T) {
+	registry := newTestRegistry()
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.CommandFactory = fakeFactory(newFakeRunner(100), newFakeRunner(101))
+	svc.Metrics = registry
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+
+	// A restart which never reaches Starting is not counted.
+	svc.Configure(func(svc *Service) {
+		svc.RestartSchedule = "every day"
+	})
+	h.send(Restart)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the schedule rejected")
+	}
+	svc.Configure(func(svc *Service) {
+		svc.RestartSchedule = ""
+	})
+
+	// Neither is a start stopped by Shutdown once it is ready.
+	h.send(Start)
+	h.expect(Starting)
+	h.shutdown()
+
+	for key, want := range map[string]float64{
+		`service_restarts_total{commanded="true"}`: 0,
+		`service_start_failures_total{}`:           0,
+	} {
+		if value := registry.scrape(key); value != want {
+			t.Errorf("%s => %v, wanted %v", key, value, want)
+		}
+	}
+	if restarts := svc.CommandRestarts(); restarts != 0 {
+		t.Errorf("svc.CommandRestarts() => %d, wanted 0", restarts)
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OrphanPolicy decides what Run does with a process left running by a
+// previous supervisor, for example one which crashed. The process is found
+// through the PID in PidFile when Run starts, and is only taken to be the
+// service's if it runs the service's command line. Otherwise the PID has
+// been reused, so the stale PidFile is removed and the process left alone.
+type OrphanPolicy string
+
+// Orphan policies.
+const (
+	OrphanIgnore OrphanPolicy = "ignore" // Leave the process alone.
+	OrphanKill   OrphanPolicy = "kill"   // Kill the process.
+	OrphanAdopt  OrphanPolicy = "adopt"  // Adopt the process as the service's process.
+)
+
+// ErrOrphanExited is the error of the exit of an adopted process. The service
+// is not its parent so its exit status is unknown.
+var ErrOrphanExited = errors.New("adopted process exited")
+
+// orphanRunner is a process left running by a previous supervisor and
+// adopted by the service.
+type orphanRunner struct {
+	process *os.Process
+}
+
+// Start does nothing since the process is already running.
+func (r *orphanRunner) Start() error {
+	return nil
+}
+
+// Wait polls the process until it exits. The process is not a child of the
+// service so it can't be waited for.
+func (r *orphanRunner) Wait() error {
+	for alive(r.process) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return ErrOrphanExited
+}
+
+// Signal sends a signal to the process.
+func (r *orphanRunner) Signal(sig os.Signal) error {
+	return r.process.Signal(sig)
+}
+
+// Kill kills the process.
+func (r *orphanRunner) Kill() error {
+	return r.process.Kill()
+}
+
+// Pid returns the PID of the process.
+func (r *orphanRunner) Pid() int {
+	return r.process.Pid
+}
+
+// alive returns true if process is running. A zombie has already exited and
+// is not running.
+func alive(process *os.Process) bool {
+	if process.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+	state, err := readProcessState(process.Pid)
+	return err != nil || state != 'Z' && state != 'X'
+}
+
+// readPidFile returns the PID in the file at path.
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// reconcile handles a process still alive at the PID in the PidFile of cfg
+// according to its Orphans policy. It returns the process if it is adopted,
+// or nil if there is none, it was killed or it is not the service's.
+func (s *Service) reconcile(cfg *settings) Runner {
+	if cfg.pidFile == "" || cfg.orphans == "" || cfg.orphans == OrphanIgnore {
+		return nil
+	}
+	pid, err := readPidFile(cfg.pidFile)
+	if err != nil || pid <= 1 || pid == os.Getpid() {
+		return nil
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil || !alive(process) {
+		return nil
+	}
+
+	want := s.argv()
+	if cfg.processTitle != "" {
+		want = append([]string{cfg.processTitle}, want[1:]...)
+	}
+	if args, err := processArgs(pid); err != nil || !slices.Equal(args, want) {
+		cfg.log(slog.LevelInfo, "removed stale PidFile of another process", "pid", pid)
+		os.Remove(cfg.pidFile)
+		return nil
+	}
+	if cfg.orphans == OrphanAdopt {
+		cfg.log(slog.LevelInfo, "adopted orphaned process", "pid", pid)
+		return &orphanRunner{process}
+	}
+
+	if err := process.Kill(); err != nil {
+		cfg.log(slog.LevelWarn, "failed to kill orphaned process", "pid", pid, "error", err)
+		return nil
+	}
+	if !waitExit(pid, cfg.stopTimeout) {
+		cfg.log(slog.LevelWarn, "orphaned process is still running after it was killed", "pid", pid)
+	} else {
+		cfg.log(slog.LevelWarn, "killed orphaned process", "pid", pid)
+	}
+	os.Remove(cfg.pidFile)
+	return nil
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startOrphan starts a process as if it was left running by a previous
+// supervisor which wrote its PID to path.
+func startOrphan(t *testing.T, path string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting orphan => %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// The command line is the test's until the orphan has exec'd.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if running, _ := processArgs(cmd.Process.Pid); slices.Equal(running, args) {
+			break
+		}
+	}
+	if err := writePidFile(path, cmd.Process.Pid); err != nil {
+		t.Fatalf("writing PidFile => %s", err)
+	}
+	return cmd
+}
+
+// waitOrphan waits for the orphan to exit and returns false if it is still
+// running after timeout.
+func waitOrphan(cmd *exec.Cmd, timeout time.Duration) bool {
+	exited := make(chan struct{})
+	go func() {
+		cmd.Process.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestOrphanAdopt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.pid")
+	orphan := startOrphan(t, path, "sleep", "30")
+
+	svc, _ := NewService([]string{"sleep", "30"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.PidFile = path
+	svc.Orphans = OrphanAdopt
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.expect(Starting, Running)
+	if pid := svc.Pid(); pid != orphan.Process.Pid {
+		t.Errorf("svc.Pid() => %d, wanted the orphan's %d", pid, orphan.Process.Pid)
+	}
+	if pid, _ := readPidFile(path); pid != orphan.Process.Pid {
+		t.Errorf("PidFile => %d, wanted the orphan's %d", pid, orphan.Process.Pid)
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	if !waitOrphan(orphan, 5*time.Second) {
+		t.Errorf("adopted orphan still running after Stop")
+	}
+}
+
+func TestOrphanKill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.pid")
+	orphan := startOrphan(t, path, "sleep", "30")
+
+	svc, _ := NewService([]string{"sleep", "30"})
+	svc.PidFile = path
+	svc.Orphans = OrphanKill
+
+	h := run(t, svc)
+	if !waitOrphan(orphan, 5*time.Second) {
+		t.Errorf("orphan still running, wanted it killed")
+	}
+	if state := svc.State(); state != Stopped {
+		t.Errorf("svc.State() => %s, wanted %s", state, Stopped)
+	}
+	h.shutdown()
+}
+
+func TestOrphanReusedPid(t *testing.T) {
+	for _, policy := range []OrphanPolicy{OrphanKill, OrphanAdopt} {
+		// The PID was reused by a process which is not the service's.
+		path := filepath.Join(t.TempDir(), "service.pid")
+		other := startOrphan(t, path, "sleep", "31")
+
+		svc, _ := NewService([]string{"sleep", "30"})
+		svc.PidFile = path
+		svc.Orphans = policy
+
+		h := run(t, svc)
+		if state := svc.State(); state != Stopped {
+			t.Errorf("%s: svc.State() => %s, wanted %s", policy, state, Stopped)
+		}
+		h.shutdown()
+		if waitOrphan(other, 200*time.Millisecond) {
+			t.Errorf("%s: unrelated process exited, wanted it left running", policy)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: stale PidFile => %v, wanted it removed", policy, err)
+		}
+	}
+}
+
+func TestOrphanIgnore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.pid")
+	orphan := startOrphan(t, path, "sleep", "30")
+
+	svc, _ := NewService([]string{"sleep", "30"})
+	svc.PidFile = path
+
+	h := run(t, svc)
+	h.shutdown()
+	if waitOrphan(orphan, 200*time.Millisecond) {
+		t.Errorf("orphan exited, wanted it left running without Orphans")
+	}
+	if pid, _ := readPidFile(path); pid != orphan.Process.Pid {
+		t.Errorf("PidFile => %d, wanted it left alone", pid)
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DroppedOutput gets the number of output bytes which were not forwarded to
+// Stdout or Stderr.
+func (s *Service) DroppedOutput() int64 {
+	return s.dropped.Load()
+}
+
+// streamBuffer is the number of lines buffered for each StreamOutput channel.
+const streamBuffer = 100
+
+// StreamOutput returns a channel which receives each line of output written
+// by the process from now until ctx is done, at which point the channel is
+// closed. Output is only streamed when CaptureOutput is set. A reader which
+// falls more than streamBuffer lines behind misses lines rather than slowing
+// down the process.
+func (s *Service) StreamOutput(ctx context.Context) <-chan string {
+	stream := make(chan string, streamBuffer)
+	s.mutex.Lock()
+	if s.streams == nil {
+		s.streams = make(map[chan string]bool)
+	}
+	s.streams[stream] = true
+	s.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		delete(s.streams, stream)
+		close(stream)
+		s.mutex.Unlock()
+	}()
+	return stream
+}
+
+// broadcast sends a line of output to each StreamOutput channel.
+func (s *Service) broadcast(line string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for stream := range s.streams {
+		select {
+		case stream <- line:
+		default:
+		}
+	}
+}
+
+// outputPatterns compiles the RestartOnOutput expressions.
+func (s *Service) outputPatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(s.RestartOnOutput))
+	for _, expr := range s.RestartOnOutput {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RestartOnOutput: %w", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// output wraps a Stdout or Stderr writer according to the service's output
+// settings. Lines matching one of patterns are sent to Run.
+func (s *Service) output(writer io.Writer, patterns []*regexp.Regexp) io.Writer {
+	if writer == nil && len(patterns) == 0 && !s.CaptureOutput {
+		return nil
+	}
+	if writer == nil {
+		writer = io.Discard
+	}
+	if s.OutputRateLimit > 0 {
+		writer = &rateWriter{
+			writer:  writer,
+			rate:    float64(s.OutputRateLimit),
+			drop:    s.OutputDrop,
+			dropped: &s.dropped,
+			tokens:  float64(s.OutputRateLimit),
+			last:    time.Now(),
+		}
+	}
+	if len(patterns) > 0 || s.CaptureOutput {
+		capture := s.CaptureOutput
+		matches := s.outputMatch
+		writer = &lineWriter{writer: writer, handler: func(line []byte) {
+			if capture {
+				s.broadcast(string(line))
+			}
+			for _, pattern := range patterns {
+				if pattern.Match(line) {
+					select {
+					case matches <- string(line):
+					default:
+					}
+					return
+				}
+			}
+		}}
+	}
+	return writer
+}
+
+// syncWriter serializes writes to a writer shared by Stdout and Stderr so
+// that the output of one stream is not torn by the other.
+type syncWriter struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+// Write writes p to the underlying writer while holding the lock.
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(p)
+}
+
+// sharedOutput returns the writers to use for Stdout and Stderr. Writers
+// other than files are wrapped in a retryWriter. When Stdout and Stderr are
+// the same writer they share a single retryWriter behind a syncWriter, since
+// os/exec copies to it from two pipes.
+func (s *Service) sharedOutput(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if _, ok := stdout.(*os.File); ok || stdout == nil || !sameWriter(stdout, stderr) {
+		return s.retry(stdout), s.retry(stderr)
+	}
+	shared := &syncWriter{writer: s.retry(stdout)}
+	return shared, shared
+}
+
+// retry wraps writer in a retryWriter unless it is nil or a file, which
+// os/exec hands to the process directly.
+func (s *Service) retry(writer io.Writer) io.Writer {
+	if _, ok := writer.(*os.File); ok || writer == nil {
+		return writer
+	}
+	return &retryWriter{writer: writer, dropped: &s.dropped, logger: s.Logger}
+}
+
+// sameWriter returns true if a and b are the same writer. Writers of types
+// that can't be compared are never the same.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// maxLineLength is the longest line a lineWriter buffers before handling it.
+const maxLineLength = 64 * 1024
+
+// lineWriter passes output through to an underlying writer and calls handler
+// with each complete line, without its newline.
+type lineWriter struct {
+	writer  io.Writer
+	handler func(line []byte)
+	buffer  []byte
+}
+
+// Write writes p to the underlying writer and handles the lines in it.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		w.handler(w.buffer[:i])
+		w.buffer = w.buffer[i+1:]
+	}
+	if len(w.buffer) > maxLineLength {
+		w.handler(w.buffer)
+		w.buffer = nil
+	}
+	w.buffer = append([]byte(nil), w.buffer...)
+	return w.writer.Write(p)
+}
+
+// retryWriter protects the copy of process output to a user supplied writer.
+// Short writes are retried, and bytes which cannot be written are counted as
+// dropped rather than returning an error. An error would stop the copy and
+// leave the process writing to a pipe that nobody reads. The error which
+// starts each run of dropped writes is logged as a warning to logger.
+type retryWriter struct {
+	writer  io.Writer
+	dropped *atomic.Int64
+	logger  *slog.Logger
+	failing bool
+}
+
+// maxWriteRetries is the number of consecutive writes without progress
+// before a retryWriter gives up and drops the remaining bytes.
+const maxWriteRetries = 3
+
+// Write writes all of p to the underlying writer and never fails.
+func (w *retryWriter) Write(p []byte) (int, error) {
+	written, retries := 0, 0
+	var err error
+	for written < len(p) && retries < maxWriteRetries {
+		var n int
+		n, err = w.writer.Write(p[written:])
+		written += n
+		if err != nil && !errors.Is(err, io.ErrShortWrite) {
+			break
+		}
+		if n == 0 {
+			retries++
+		} else {
+			retries = 0
+		}
+	}
+	if written == len(p) {
+		w.failing = false
+		return len(p), nil
+	}
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	if !w.failing && w.logger != nil {
+		w.logger.Log(context.Background(), slog.LevelWarn, "dropping process output", "error", err)
+	}
+	w.failing = true
+	w.dropped.Add(int64(len(p) - written))
+	return len(p), nil
+}
+
+// rateWriter limits the bytes per second written to an underlying writer
+// with a token bucket which holds up to one second of output.
+type rateWriter struct {
+	writer  io.Writer
+	rate    float64
+	drop    bool
+	dropped *atomic.Int64
+	tokens  float64
+	last    time.Time
+	mutex   sync.Mutex
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (w *rateWriter) refill() {
+	now := time.Now()
+	w.tokens += now.Sub(w.last).Seconds() * w.rate
+	if w.tokens > w.rate {
+		w.tokens = w.rate
+	}
+	w.last = now
+}
+
+// Write forwards p to the underlying writer. When over the rate, the excess
+// is dropped if drop is set, otherwise Write waits until it can be written.
+func (w *rateWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	written := 0
+	for written < len(p) {
+		w.refill()
+		n := len(p) - written
+		if n > int(w.tokens) {
+			n = int(w.tokens)
+		}
+		if n == 0 {
+			if w.drop {
+				w.dropped.Add(int64(len(p) - written))
+				return len(p), nil
+			}
+			time.Sleep(time.Duration((1 - w.tokens) / w.rate * float64(time.Second)))
+			continue
+		}
+
+		m, err := w.writer.Write(p[written : written+n])
+		w.tokens -= float64(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
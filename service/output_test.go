@@ -0,0 +1,359 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	count int
+	mutex sync.Mutex
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.count += len(p)
+	return len(p), nil
+}
+
+func (w *countWriter) Count() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.count
+}
+
+func TestOutputRateLimitDrop(t *testing.T) {
+	stdout := &countWriter{}
+	svc, _ := NewService([]string{"sh", "-c", "head -c 100000 /dev/zero; sleep 0.5"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = stdout
+	svc.OutputRateLimit = 10000
+	svc.OutputDrop = true
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+
+	written, dropped := stdout.Count(), svc.DroppedOutput()
+	if written > 2*svc.OutputRateLimit {
+		t.Errorf("wrote %d bytes, wanted at most about %d", written, svc.OutputRateLimit)
+	}
+	if int(dropped)+written != 100000 {
+		t.Errorf("svc.DroppedOutput() => %d with %d written, wanted a total of 100000", dropped, written)
+	}
+}
+
+func TestOutputRateLimitWait(t *testing.T) {
+	stdout := &countWriter{}
+	svc, _ := NewService([]string{"sh", "-c", "head -c 100000 /dev/zero; sleep 0.2"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = stdout
+	svc.OutputRateLimit = 50000
+
+	h := run(t, svc)
+	defer h.shutdown()
+	start := time.Now()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("forwarded 100000 bytes in %s, wanted at least 1s at %d bytes per second", elapsed, svc.OutputRateLimit)
+	}
+	if written := stdout.Count(); written != 100000 || svc.DroppedOutput() != 0 {
+		t.Errorf("wrote %d bytes and dropped %d, wanted 100000 and 0", written, svc.DroppedOutput())
+	}
+}
+
+// shortWriter accepts at most three bytes per write.
+type shortWriter struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(p) > 3 {
+		n, _ := w.buffer.Write(p[:3])
+		return n, io.ErrShortWrite
+	}
+	return w.buffer.Write(p)
+}
+
+// failWriter fails every write.
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestOutputShortWrites(t *testing.T) {
+	stdout := &shortWriter{}
+	svc, _ := NewService([]string{"sh", "-c", "echo hello world; sleep 0.2"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = stdout
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+
+	if output := stdout.buffer.String(); output != "hello world\n" {
+		t.Errorf("stdout => %q, wanted %q", output, "hello world\n")
+	}
+	if dropped := svc.DroppedOutput(); dropped != 0 {
+		t.Errorf("svc.DroppedOutput() => %d, wanted 0", dropped)
+	}
+}
+
+func TestOutputWriterError(t *testing.T) {
+	handler := &captureHandler{}
+	svc, _ := NewService([]string{"sh", "-c", "echo one; sleep 0.2; echo two"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = failWriter{}
+	svc.Logger = slog.New(handler)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// The process outlives the failed writes and exits on its own.
+	event := h.expect(Exited)[0]
+	var exitErr ExitError
+	if !errors.As(event.Error, &exitErr) || exitErr.Err != nil {
+		t.Errorf("event.Error => %v, wanted a successful exit", event.Error)
+	}
+	if dropped := svc.DroppedOutput(); dropped != 8 {
+		t.Errorf("svc.DroppedOutput() => %d, wanted 8", dropped)
+	}
+	// Only the first of the consecutive failed writes is logged.
+	if warnings := handler.find("dropping process output"); len(warnings) != 1 || warnings[0]["error"] != "disk full" {
+		t.Errorf("dropping process output records => %v, wanted one for disk full", warnings)
+	}
+}
+
+func TestRestartOnOutput(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", `sleep 0.2; echo "FATAL: disk full"; exec sleep 10`})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.RestartOnOutput = []string{"^FATAL:"}
+	svc.RestartOnOutputDebounce = 10 * time.Second
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	events := h.expect(Stopping, Stopped, Starting, Running)
+	if events[0].Error == nil || !strings.Contains(events[0].Error.Error(), "FATAL: disk full") {
+		t.Errorf("event.Error => %v, wanted the matched line", events[0].Error)
+	}
+
+	// The restarted process matches again within the debounce period.
+	select {
+	case event := <-h.events:
+		t.Errorf("event.State => %s, wanted no restart within the debounce period", event.State)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestRestartOnOutputInvalid(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StopRestart = false
+	svc.RestartOnOutput = []string{"("}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	event := h.expect(Starting, Exited)[1]
+	if event.Error == nil || !strings.Contains(event.Error.Error(), "RestartOnOutput") {
+		t.Errorf("event.Error => %v, wanted invalid RestartOnOutput", event.Error)
+	}
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Success() => true, wanted false")
+	}
+}
+
+func TestStreamOutput(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", "echo before; sleep 0.3; echo one; echo two >&2; exec sleep 10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.CaptureOutput = true
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streams := []<-chan string{svc.StreamOutput(ctx), svc.StreamOutput(ctx)}
+	for i, stream := range streams {
+		// Stdout and stderr are copied separately so their order may vary.
+		lines := map[string]bool{}
+		for len(lines) < 2 {
+			select {
+			case line := <-stream:
+				lines[line] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream %d timed out, received %v", i, lines)
+			}
+		}
+		if !lines["one"] || !lines["two"] {
+			t.Errorf("stream %d received %v, wanted one and two", i, lines)
+		}
+	}
+
+	cancel()
+	for i, stream := range streams {
+		select {
+		case line, ok := <-stream:
+			if ok {
+				t.Errorf("stream %d received %q after cancel, wanted it closed", i, line)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("stream %d not closed after cancel", i)
+		}
+	}
+}
+
+func TestSharedOutput(t *testing.T) {
+	out := strings.Repeat("o", 100)
+	err := strings.Repeat("e", 100)
+	script := fmt.Sprintf(`sleep 0.1; for i in $(seq 500); do echo %s; done & for i in $(seq 500); do echo %s >&2; done; wait`, out, err)
+
+	var buffer bytes.Buffer
+	svc, _ := NewService([]string{"sh", "-c", script})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.StopRestart = false
+	svc.Stdout = &buffer
+	svc.Stderr = &buffer
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+	h.shutdown()
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 1000 {
+		t.Errorf("got %d lines, wanted 1000", len(lines))
+	}
+	for _, line := range lines {
+		if line != out && line != err {
+			t.Fatalf("torn line %q", line)
+		}
+	}
+}
+
+func TestSharedOutputWrapper(t *testing.T) {
+	var buffer bytes.Buffer
+	svc, _ := NewService([]string{"true"})
+	stdout, stderr := svc.sharedOutput(&buffer, &buffer)
+	if stdout != stderr {
+		t.Fatalf("sharedOutput(w, w) => %T, %T, wanted a single writer", stdout, stderr)
+	}
+	if shared, ok := stdout.(*syncWriter); !ok {
+		t.Errorf("sharedOutput(w, w) => %T, wanted *syncWriter", stdout)
+	} else if _, ok := shared.writer.(*retryWriter); !ok {
+		t.Errorf("shared writer => %T, wanted *retryWriter", shared.writer)
+	}
+
+	var other bytes.Buffer
+	stdout, stderr = svc.sharedOutput(&buffer, &other)
+	if stdout == stderr {
+		t.Errorf("sharedOutput(a, b) => a single writer, wanted two")
+	}
+}
+
+func TestStdin(t *testing.T) {
+	var buffer bytes.Buffer
+	svc, _ := NewService([]string{"sh", "-c", "cat; exec sleep 10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Stdin = strings.NewReader("hello\n")
+	svc.Stdout = &buffer
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.shutdown()
+
+	if output := buffer.String(); output != "hello\n" {
+		t.Errorf("stdout => %q, wanted %q", output, "hello\n")
+	}
+}
+
+func TestStdinFactory(t *testing.T) {
+	var buffer bytes.Buffer
+	svc, _ := NewService([]string{"sh", "-c", "cat; exec sleep 10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StdinFactory = func() io.Reader { return strings.NewReader("hello\n") }
+	svc.Stdout = &buffer
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Restart)
+	h.expect(Stopping, Stopped, Starting, Running)
+	h.response()
+	h.shutdown()
+
+	if output := buffer.String(); output != "hello\nhello\n" {
+		t.Errorf("stdout => %q, wanted a fresh stdin for each start", output)
+	}
+}
+
+func TestStdinError(t *testing.T) {
+	var buffer bytes.Buffer
+	failure := errors.New("read failed")
+	stdinErrors := make(chan error, 1)
+	svc, _ := NewService([]string{"sh", "-c", "cat; echo EOF; exec sleep 10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Stdin = io.MultiReader(strings.NewReader("hello\n"), iotest.ErrReader(failure))
+	svc.Stdout = &buffer
+	svc.OnStdinError = func(err error) { stdinErrors <- err }
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	select {
+	case err := <-stdinErrors:
+		if err != failure {
+			t.Errorf("OnStdinError(%v), wanted %v", err, failure)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnStdinError was not called")
+	}
+	h.shutdown()
+
+	if output := buffer.String(); output != "hello\nEOF\n" {
+		t.Errorf("stdout => %q, wanted the process to read EOF after %q", output, "hello\n")
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writePidFile atomically replaces the file at path with pid followed by a
+// newline. The PID is written to a temporary file in the same directory which
+// is then renamed over path so that readers never see a partial file.
+func writePidFile(path string, pid int) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(strconv.Itoa(pid) + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// updatePidFile writes the PID of the process to the file at path when the
+// service enters Running and removes the file when the process is no longer
+// running. Nothing is written if path is empty. Failure is ignored.
+func (s *Service) updatePidFile(path string, state State) {
+	if path == "" {
+		return
+	}
+	switch state {
+	case Running:
+		writePidFile(path, s.command.Pid())
+	case Stopped, Exited, Backoff, Fatal:
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPidFile(t *testing.T) {
+	dir := t.TempDir()
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.PidFile = filepath.Join(dir, "service.pid")
+
+	verifyPidFile := func() int {
+		t.Helper()
+		data, err := os.ReadFile(svc.PidFile)
+		if err != nil {
+			t.Fatalf("reading PidFile => %s", err)
+		}
+		if want := strconv.Itoa(svc.Pid()) + "\n"; string(data) != want {
+			t.Errorf("PidFile contains %q, wanted %q", data, want)
+		}
+		return svc.Pid()
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := verifyPidFile()
+
+	h.send(Restart)
+	h.expect(Stopping, Stopped, Starting, Running)
+	h.response()
+	if verifyPidFile() == pid {
+		t.Errorf("PidFile kept PID %d after Restart", pid)
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	if _, err := os.Stat(svc.PidFile); !os.IsNotExist(err) {
+		t.Errorf("PidFile exists after Stop, wanted it removed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("left %d files behind, wanted none", len(entries))
+	}
+}
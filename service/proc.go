@@ -0,0 +1,39 @@
+package service
+
+import (
+	"time"
+)
+
+// waitExit blocks until the process with the given pid is no longer running,
+// or for at most timeout. A zombie has already exited and is only waiting to
+// be reaped, so it is not considered running. If the state of the process
+// cannot be determined it is assumed to have exited. It returns false if the
+// process was still running after timeout.
+func waitExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := readProcessState(pid)
+		if err != nil || state == 'Z' || state == 'X' {
+			return true
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		if remaining > 100*time.Millisecond {
+			remaining = 100 * time.Millisecond
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// readProcessState returns the state of a process. Replaced in tests to
+// simulate process states.
+var readProcessState = processState
+
+// uninterruptible returns true if the process with the given pid is in
+// uninterruptible sleep, where it can't be killed until its I/O completes.
+func uninterruptible(pid int) bool {
+	state, err := readProcessState(pid)
+	return err == nil && state == 'D'
+}
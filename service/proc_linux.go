@@ -0,0 +1,39 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// processState returns the state field of /proc/<pid>/stat, e.g. R for
+// running, S for sleeping or Z for zombie.
+func processState(pid int) (byte, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseProcState(stat)
+}
+
+// processArgs returns the command line of a process from
+// /proc/<pid>/cmdline.
+func processArgs(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00"), nil
+}
+
+// parseProcState extracts the state field from the contents of a stat file.
+// The command name in parentheses may itself contain spaces or parentheses so
+// the state is located after the last closing parenthesis.
+func parseProcState(stat []byte) (byte, error) {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) || stat[i+1] != ' ' {
+		return 0, fmt.Errorf("malformed stat: %q", stat)
+	}
+	return stat[i+2], nil
+}
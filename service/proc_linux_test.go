@@ -0,0 +1,174 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseProcState(t *testing.T) {
+	tests := []struct {
+		stat  string
+		state byte
+	}{
+		{"123 (sleep) S 1 123 123 0 -1", 'S'},
+		{"123 (my (odd) name) R 1 123", 'R'},
+		{"123 (a) b) Z 1 123", 'Z'},
+	}
+	for _, test := range tests {
+		state, err := parseProcState([]byte(test.stat))
+		if err != nil || state != test.state {
+			t.Errorf("parseProcState(%q) => %q, %v, wanted %q", test.stat, state, err, test.state)
+		}
+	}
+	if _, err := parseProcState([]byte("123 (truncated")); err == nil {
+		t.Errorf("parseProcState(truncated) => nil error, wanted error")
+	}
+}
+
+func TestProcessStateZombie(t *testing.T) {
+	if state, err := processState(os.Getpid()); err != nil || state == 'Z' {
+		t.Fatalf("processState(self) => %q, %v, wanted a live state", state, err)
+	}
+
+	cmd := exec.Command("sleep", "0.3")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+
+	// The process is alive until it exits and becomes a zombie since it is
+	// not waited on, so waitExit must block until then.
+	start := time.Now()
+	if !waitExit(pid, 5*time.Second) {
+		t.Errorf("waitExit timed out while the process exited")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("waitExit returned after %s while the process was alive", elapsed)
+	}
+	if state, err := processState(pid); err != nil || state != 'Z' {
+		t.Errorf("processState(exited child) => %q, %v, wanted 'Z'", state, err)
+	}
+
+	cmd.Wait()
+	if _, err := processState(pid); err == nil {
+		t.Errorf("processState(reaped child) => nil error, wanted error")
+	}
+}
+
+func TestProcessTitle(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.ProcessTitle = "my-worker"
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", svc.Pid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := bytes.Split(cmdline, []byte{0})
+	if string(args[0]) != svc.ProcessTitle || string(args[1]) != "10" {
+		t.Errorf("process command line => %q, wanted %s 10", cmdline, svc.ProcessTitle)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.Directory = "/"
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Credential = &Credential{Uid: 65534, Gid: 65534}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", svc.Pid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+			if fields[1] != "65534" {
+				t.Errorf("process Uid => %s, wanted 65534", fields[1])
+			}
+			return
+		}
+	}
+	t.Errorf("no Uid in /proc/%d/status", svc.Pid())
+}
+
+func TestCredentialNotPermitted(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root may switch to any user")
+	}
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Credential = &Credential{Uid: 0, Gid: 0}
+	svc.StopRestart = false
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	events := h.expect(Starting, Exited)
+	if !errors.Is(events[1].Error, syscall.EPERM) || !strings.Contains(events[1].Error.Error(), "uid 0") {
+		t.Errorf("event.Error => %v, wanted a permission error naming the uid", events[1].Error)
+	}
+	h.response()
+	select {
+	case event := <-h.events:
+		t.Errorf("got %s event after the start failed, wanted no restart", event.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCloseOnExec(t *testing.T) {
+	// A descriptor opened without O_CLOEXEC, as by a C library.
+	leaked, err := syscall.Open("/dev/null", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(leaked)
+	extra, err := os.Open("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+
+	for _, closeOnExec := range []bool{false, true} {
+		svc, _ := NewService([]string{"sleep", "10"})
+		svc.StartTimeout = 100 * time.Millisecond
+		svc.ExtraFiles = []*os.File{extra}
+		svc.CloseOnExec = closeOnExec
+
+		h := run(t, svc)
+		h.send(Start)
+		h.expect(Starting, Running)
+		h.response()
+		_, leakedErr := os.Stat(fmt.Sprintf("/proc/%d/fd/%d", svc.Pid(), leaked))
+		_, extraErr := os.Stat(fmt.Sprintf("/proc/%d/fd/3", svc.Pid()))
+		h.shutdown()
+
+		if inherited := leakedErr == nil; inherited == closeOnExec {
+			t.Errorf("CloseOnExec=%t: descriptor %d inherited %t, wanted %t", closeOnExec, leaked, inherited, !closeOnExec)
+		}
+		if extraErr != nil {
+			t.Errorf("CloseOnExec=%t: ExtraFiles not passed: %s", closeOnExec, extraErr)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+)
+
+// processState is not supported without /proc.
+func processState(pid int) (byte, error) {
+	return 0, errors.New("process state is not supported on this platform")
+}
+
+// processArgs is not supported without /proc.
+func processArgs(pid int) ([]string, error) {
+	return nil, errors.New("process arguments are not supported on this platform")
+}
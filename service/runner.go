@@ -0,0 +1,173 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Runner is a process run by a Service. Setting a Service's CommandFactory
+// replaces the default os/exec implementation, for example to drive the
+// service's state machine in tests without starting real processes.
+type Runner interface {
+	Start() error               // Start the process without waiting for it to exit.
+	Wait() error                // Wait for the started process to exit.
+	Signal(sig os.Signal) error // Send a signal to the process.
+	Kill() error                // Kill the process.
+	Pid() int                   // The PID of the started process.
+}
+
+// startCommand starts an *exec.Cmd. Replaced in tests to simulate failures.
+var startCommand = (*exec.Cmd).Start
+
+// execRunner runs a process with os/exec.
+type execRunner struct {
+	*exec.Cmd
+	service  *Service  // The service the process is run for.
+	settings *settings // The settings the process was started with.
+}
+
+// Start starts the process. If the pipes for its output can't be created it
+// is started again with plain output: Stdout and Stderr are passed to the
+// process directly if they are files and discarded otherwise.
+func (r *execRunner) Start() error {
+	if r.settings.closeOnExec {
+		if err := closeOnExec(); err != nil {
+			return fmt.Errorf("setting close-on-exec: %w", err)
+		}
+	}
+	err := r.start(r.Cmd)
+	if errors.Is(err, syscall.EPERM) && r.settings.credential != nil {
+		cred := r.settings.credential
+		return fmt.Errorf("not permitted to run as uid %d gid %d: %w", cred.Uid, cred.Gid, err)
+	}
+	if err == nil || !isPipeError(err) || !piped(r.Stdout) && !piped(r.Stderr) {
+		return err
+	}
+
+	cmd, cmdErr := r.service.makeCommand(r.settings)
+	if cmdErr != nil {
+		return err
+	}
+	r.service.config.Lock()
+	cmd.Stdout = plainOutput(r.service.Stdout)
+	cmd.Stderr = plainOutput(r.service.Stderr)
+	r.service.config.Unlock()
+	if err := r.start(cmd); err != nil {
+		return err
+	}
+	r.Cmd = cmd
+	if r.settings.onOutputFallback != nil {
+		go r.settings.onOutputFallback(err)
+	}
+	return nil
+}
+
+// start starts cmd. A Stdin which is not a file is copied to the process by
+// copyStdin rather than by os/exec so that a failing or blocked reader can't
+// fail or hold up Wait.
+func (r *execRunner) start(cmd *exec.Cmd) error {
+	stdin := cmd.Stdin
+	if _, ok := stdin.(*os.File); stdin == nil || ok {
+		return startCommand(cmd)
+	}
+
+	cmd.Stdin = nil
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := startCommand(cmd); err != nil {
+		cmd.Stdin = stdin
+		return err
+	}
+	go copyStdin(pipe, stdin, r.settings.onStdinError)
+	return nil
+}
+
+// Signal sends a signal to the process, or to its whole process group if it
+// leads one. Signal 0 only checks the process itself.
+func (r *execRunner) Signal(sig os.Signal) error {
+	if r.settings.processGroup && sig != syscall.Signal(0) {
+		return signalGroup(r.Process.Pid, sig)
+	}
+	return r.Process.Signal(sig)
+}
+
+// Kill kills the process, or its whole process group if it leads one.
+func (r *execRunner) Kill() error {
+	if r.settings.processGroup {
+		return signalGroup(r.Process.Pid, os.Kill)
+	}
+	return r.Process.Kill()
+}
+
+// Pid returns the PID of the process.
+func (r *execRunner) Pid() int {
+	return r.Process.Pid
+}
+
+// copyStdin copies stdin to the process and closes the pipe so that the
+// process reads EOF once stdin is exhausted or fails. Errors reading stdin are
+// passed to onError if it is set. Errors writing to a process which has closed
+// its stdin or exited are ignored.
+func copyStdin(pipe io.WriteCloser, stdin io.Reader, onError func(err error)) {
+	_, err := io.Copy(pipe, stdin)
+	pipe.Close()
+	if err != nil && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, os.ErrClosed) && onError != nil {
+		onError(err)
+	}
+}
+
+// transient returns true if err is from failing to start a process in a way
+// that may succeed if tried again, such as the binary still being open for
+// writing or running out of processes or file descriptors.
+func transient(err error) bool {
+	if errors.Is(err, ErrUnstableBinary) {
+		return true
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPipeError returns true if err is from failing to create a pipe.
+func isPipeError(err error) bool {
+	var sysErr *os.SyscallError
+	return errors.As(err, &sysErr) && strings.HasPrefix(sysErr.Syscall, "pipe")
+}
+
+// piped returns true if os/exec needs a pipe to pass output to writer.
+func piped(writer io.Writer) bool {
+	_, ok := writer.(*os.File)
+	return writer != nil && !ok
+}
+
+// plainOutput returns writer if the process can write to it directly without
+// a pipe, or nil to discard the output.
+func plainOutput(writer io.Writer) io.Writer {
+	if piped(writer) {
+		return nil
+	}
+	return writer
+}
+
+// makeRunner creates the process to run with the CommandFactory of cfg, or
+// with os/exec if it is not set.
+func (s *Service) makeRunner(cfg *settings) (Runner, error) {
+	if cfg.commandFactory != nil {
+		return cfg.commandFactory(s.argv()), nil
+	}
+	cmd, err := s.makeCommand(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &execRunner{Cmd: cmd, service: s, settings: cfg}, nil
+}
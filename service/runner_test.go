@@ -0,0 +1,578 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeRunner is a Runner which exits when told to instead of running a
+// process. A signal other than 0 makes it exit.
+type fakeRunner struct {
+	pid    int
+	exit   chan error
+	delay  time.Duration // How long Start takes.
+	immune bool          // Whether to ignore signals.
+}
+
+func newFakeRunner(pid int) *fakeRunner {
+	return &fakeRunner{pid: pid, exit: make(chan error, 1)}
+}
+
+func (r *fakeRunner) Start() error {
+	time.Sleep(r.delay)
+	return nil
+}
+
+func (r *fakeRunner) Wait() error {
+	return <-r.exit
+}
+
+func (r *fakeRunner) Signal(sig os.Signal) error {
+	if sig != syscall.Signal(0) && !r.immune {
+		r.Exit(fmt.Errorf("signal: %s", sig))
+	}
+	return nil
+}
+
+func (r *fakeRunner) Kill() error {
+	return r.Signal(os.Kill)
+}
+
+func (r *fakeRunner) Pid() int {
+	return r.pid
+}
+
+// Exit makes the process exit with err unless it has already been told to.
+func (r *fakeRunner) Exit(err error) {
+	select {
+	case r.exit <- err:
+	default:
+	}
+}
+
+// fakeFactory returns a CommandFactory which starts the given runners in order.
+func fakeFactory(runners ...*fakeRunner) func([]string) Runner {
+	return func([]string) Runner {
+		runner := runners[0]
+		runners = runners[1:]
+		return runner
+	}
+}
+
+func TestCommandFactory(t *testing.T) {
+	failure := errors.New("exit status 1")
+	crash, retry1, retry2 := newFakeRunner(100), newFakeRunner(101), newFakeRunner(102)
+	retry1.Exit(failure)
+	retry2.Exit(failure)
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.StartRetries = 1
+	svc.BackoffInitial = 10 * time.Millisecond
+	svc.CommandFactory = fakeFactory(crash, retry1, retry2)
+
+	start := time.Now()
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	if pid := svc.Pid(); pid != crash.pid {
+		t.Errorf("svc.Pid() => %d, wanted %d", pid, crash.pid)
+	}
+
+	crash.Exit(failure)
+	events := h.expect(Exited, Starting, Backoff, Starting, Fatal)
+	if !errors.Is(events[0].Error, failure) {
+		t.Errorf("event.Error => %v, wanted the runner's exit error", events[0].Error)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("state machine took %s, wanted it to run without real processes", elapsed)
+	}
+}
+
+func TestStartTimeoutAtLaunch(t *testing.T) {
+	tests := []struct {
+		atLaunch bool
+		min, max time.Duration
+	}{
+		{false, 450 * time.Millisecond, time.Second},
+		{true, 300 * time.Millisecond, 450 * time.Millisecond},
+	}
+	for _, test := range tests {
+		slow := newFakeRunner(100)
+		slow.delay = 200 * time.Millisecond
+
+		svc, _ := NewService([]string{"server"})
+		svc.StartTimeout = 300 * time.Millisecond
+		svc.StartTimeoutAtLaunch = test.atLaunch
+		svc.CommandFactory = fakeFactory(slow)
+
+		h := run(t, svc)
+		start := time.Now()
+		h.send(Start)
+		h.expect(Starting, Running)
+		elapsed := time.Since(start)
+		h.response()
+		h.shutdown()
+
+		if elapsed < test.min || elapsed >= test.max {
+			t.Errorf("StartTimeoutAtLaunch=%t: Running after %s, wanted between %s and %s", test.atLaunch, elapsed, test.min, test.max)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runners := []*fakeRunner{newFakeRunner(100), newFakeRunner(101), newFakeRunner(102), newFakeRunner(103)}
+	for _, runner := range runners {
+		runner.Exit(failure)
+	}
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.StartRetries = 3
+	svc.BackoffInitial = 50 * time.Millisecond
+	svc.BackoffFactor = 2
+	svc.BackoffMax = 150 * time.Millisecond
+	svc.CommandFactory = fakeFactory(runners...)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting)
+	for _, delay := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond} {
+		h.expect(Backoff)
+		backoff := time.Now()
+		h.expect(Starting)
+		if elapsed := time.Since(backoff); elapsed < delay || elapsed >= delay+100*time.Millisecond {
+			t.Errorf("restarted %s after Backoff, wanted about %s", elapsed, delay)
+		}
+	}
+	h.expect(Fatal)
+	h.response()
+}
+
+func TestBackoffSaturates(t *testing.T) {
+	tests := []struct {
+		initial, max, floor time.Duration
+		factor              float64
+		retries             int
+		delay               time.Duration
+	}{
+		{time.Second, time.Minute, 0, 2, 1 << 20, time.Minute},
+		{time.Second, time.Minute, time.Second, 2, 1 << 20, time.Minute + time.Second},
+		{time.Second, 0, 0, 2, 1 << 20, math.MaxInt64},
+		{time.Second, 0, time.Second, 2, 1 << 20, math.MaxInt64},
+		{-time.Second, time.Minute, 0, 2, 3, 0},
+		{time.Second, time.Minute, -time.Second, 2, 0, time.Second},
+		{time.Second, time.Minute, 0, -2, 1, 0},
+	}
+	for _, test := range tests {
+		svc, _ := NewService([]string{"server"})
+		svc.BackoffInitial = test.initial
+		svc.BackoffMax = test.max
+		svc.BackoffFloor = test.floor
+		svc.BackoffFactor = test.factor
+		if delay := svc.snapshot().backoff(test.retries); delay != test.delay {
+			t.Errorf("backoff(%d) with %+v => %s, wanted %s", test.retries, test, delay, test.delay)
+		}
+	}
+}
+
+func TestBackoffShutdown(t *testing.T) {
+	crash := newFakeRunner(100)
+	crash.Exit(errors.New("exit status 1"))
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = time.Minute
+	svc.CommandFactory = fakeFactory(crash)
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Backoff)
+	start := time.Now()
+	h.shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s during Backoff, wanted it to interrupt the wait", elapsed)
+	}
+}
+
+func TestShutdownDuringStart(t *testing.T) {
+	crash, next := newFakeRunner(100), newFakeRunner(101)
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = time.Second
+	svc.BackoffInitial = 0
+	svc.CommandFactory = fakeFactory(crash, next)
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting)
+	h.send(Shutdown)
+	if response := h.response(); response.Name != Start || response.Success() {
+		t.Errorf("response => %s, success %t, wanted a failed start", response.Name, response.Success())
+	}
+	crash.Exit(errors.New("exit status 1"))
+	h.expect(Fatal)
+	if response := h.response(); response.Name != Shutdown || !response.Success() {
+		t.Errorf("response => %s, error{%v}, wanted a successful shutdown", response.Name, response.Error)
+	}
+}
+
+func TestNextRestart(t *testing.T) {
+	crash := newFakeRunner(100)
+	crash.Exit(errors.New("exit status 1"))
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = time.Minute
+	svc.CommandFactory = fakeFactory(crash)
+
+	if next := svc.NextRestart(); !next.IsZero() {
+		t.Errorf("NextRestart() before Start => %s, wanted zero", next)
+	}
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Backoff)
+	want := time.Now().Add(svc.BackoffInitial)
+	if next := svc.NextRestart(); next.Before(want.Add(-100*time.Millisecond)) || next.After(want) {
+		t.Errorf("NextRestart() in Backoff => %s, wanted about %s", next, want)
+	}
+	h.shutdown()
+	if next := svc.NextRestart(); !next.IsZero() {
+		t.Errorf("NextRestart() after Shutdown => %s, wanted zero", next)
+	}
+}
+
+func TestRestarts(t *testing.T) {
+	crash := errors.New("exit status 1")
+	runners := []*fakeRunner{newFakeRunner(100), newFakeRunner(101), newFakeRunner(102), newFakeRunner(103)}
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.CommandFactory = fakeFactory(runners...)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	for _, runner := range runners[:2] {
+		runner.Exit(crash)
+		h.expect(Exited, Starting, Running)
+	}
+	if restarts := svc.Restarts(); restarts != 2 {
+		t.Errorf("svc.Restarts() => %d, wanted 2", restarts)
+	}
+
+	h.send(Restart)
+	running := h.expect(Stopping, Stopped, Starting, Running)[3]
+	h.response()
+	if running.Restarts != 2 || running.CommandRestarts != 1 {
+		t.Errorf("event.Restarts, event.CommandRestarts => %d, %d, wanted 2, 1", running.Restarts, running.CommandRestarts)
+	}
+	if restarts := svc.CommandRestarts(); restarts != 1 {
+		t.Errorf("svc.CommandRestarts() => %d, wanted 1", restarts)
+	}
+}
+
+func TestHealthyAfter(t *testing.T) {
+	failure := errors.New("exit status 1")
+	tests := []struct {
+		run    time.Duration
+		states []State
+	}{
+		{300 * time.Millisecond, []State{Exited, Starting, Backoff, Starting, Running}},
+		{0, []State{Exited, Starting, Fatal}},
+	}
+	for _, test := range tests {
+		fail1, healthy, fail2, recovered := newFakeRunner(100), newFakeRunner(101), newFakeRunner(102), newFakeRunner(103)
+		fail1.Exit(failure)
+		fail2.Exit(failure)
+
+		svc, _ := NewService([]string{"server"})
+		svc.StartTimeout = 10 * time.Millisecond
+		svc.StartRetries = 1
+		svc.BackoffInitial = 10 * time.Millisecond
+		svc.HealthyAfter = 200 * time.Millisecond
+		svc.CommandFactory = fakeFactory(fail1, healthy, fail2, recovered)
+
+		h := run(t, svc)
+		h.send(Start)
+		h.expect(Starting, Backoff, Starting, Running)
+		h.response()
+
+		time.Sleep(test.run)
+		healthy.Exit(failure)
+		h.expect(test.states...)
+		h.shutdown()
+	}
+}
+
+func TestBackoffFloor(t *testing.T) {
+	failure := errors.New("exit status 1")
+	fail, recovered := newFakeRunner(100), newFakeRunner(101)
+	fail.Exit(failure)
+
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = time.Millisecond
+	svc.BackoffFloor = 200 * time.Millisecond
+	svc.CommandFactory = fakeFactory(fail, recovered)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Backoff)
+	backoff := time.Now()
+	h.expect(Starting)
+	if elapsed := time.Since(backoff); elapsed < svc.BackoffFloor {
+		t.Errorf("restarted %s after Backoff, wanted at least %s", elapsed, svc.BackoffFloor)
+	}
+	h.expect(Running)
+	h.response()
+}
+
+func TestOutputFallback(t *testing.T) {
+	defer func(start func(*exec.Cmd) error) { startCommand = start }(startCommand)
+	startCommand = func(cmd *exec.Cmd) error {
+		if piped(cmd.Stdout) || piped(cmd.Stderr) {
+			return os.NewSyscallError("pipe2", syscall.EMFILE)
+		}
+		return cmd.Start()
+	}
+
+	fallback := make(chan error, 1)
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Stdout = &bytes.Buffer{}
+	svc.CaptureOutput = true
+	svc.OnOutputFallback = func(err error) { fallback <- err }
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Error => %v, wanted nil", response.Error)
+	}
+
+	select {
+	case err := <-fallback:
+		if !errors.Is(err, syscall.EMFILE) {
+			t.Errorf("OnOutputFallback(%v), wanted the pipe error", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("OnOutputFallback not called")
+	}
+}
+
+func TestTransientStartFailure(t *testing.T) {
+	defer func(start func(*exec.Cmd) error) { startCommand = start }(startCommand)
+	attempts := 0
+	startCommand = func(cmd *exec.Cmd) error {
+		if attempts++; attempts == 1 {
+			return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.EAGAIN}
+		}
+		return cmd.Start()
+	}
+
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.BackoffInitial = 10 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	events := h.expect(Starting, Backoff, Starting, Running)
+	if !errors.Is(events[1].Error, syscall.EAGAIN) {
+		t.Errorf("Backoff event.Error => %v, wanted EAGAIN", events[1].Error)
+	}
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Error => %v, wanted nil", response.Error)
+	}
+}
+
+func TestTransientStartFailureRetries(t *testing.T) {
+	defer func(start func(*exec.Cmd) error) { startCommand = start }(startCommand)
+	startCommand = func(cmd *exec.Cmd) error {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: syscall.EAGAIN}
+	}
+
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartRetries = 1
+	svc.BackoffInitial = 10 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Backoff, Starting, Fatal)
+	if response := h.response(); !errors.Is(response.Error, syscall.EAGAIN) {
+		t.Errorf("response.Error => %v, wanted EAGAIN", response.Error)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	failure := errors.New("exit status 1")
+	tests := []struct {
+		policy  RestartPolicy
+		err     error
+		restart bool
+	}{
+		{RestartNever, nil, false},
+		{RestartNever, failure, false},
+		{RestartOnFailure, nil, false},
+		{RestartOnFailure, failure, true},
+		{RestartAlways, nil, true},
+		{RestartAlways, failure, true},
+	}
+	for _, test := range tests {
+		first, second := newFakeRunner(100), newFakeRunner(101)
+
+		svc, _ := NewService([]string{"server"})
+		svc.StartTimeout = 10 * time.Millisecond
+		svc.RestartPolicy = test.policy
+		svc.CommandFactory = fakeFactory(first, second)
+
+		h := run(t, svc)
+		h.send(Start)
+		h.expect(Starting, Running)
+		h.response()
+
+		first.Exit(test.err)
+		h.expect(Exited)
+		select {
+		case event := <-h.events:
+			if !test.restart || event.State != Starting {
+				t.Errorf("%s with error %v: got %s event, wanted restart %t", test.policy, test.err, event.State, test.restart)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.restart {
+				t.Errorf("%s with error %v: not restarted", test.policy, test.err)
+			}
+		}
+		h.shutdown()
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runners := []*fakeRunner{newFakeRunner(100), newFakeRunner(101), newFakeRunner(102), newFakeRunner(103)}
+
+	var attempts []int
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.CommandFactory = fakeFactory(runners...)
+	svc.ShouldRestart = func(exitErr error, code int, attempt int) bool {
+		attempts = append(attempts, attempt)
+		return attempt < 3
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	for _, runner := range runners[:2] {
+		runner.Exit(failure)
+		h.expect(Exited, Starting, Running)
+	}
+	runners[2].Exit(failure)
+	events := h.expect(Exited, Fatal)
+	if !errors.Is(events[1].Error, ErrRestartVetoed) {
+		t.Errorf("event.Error => %v, wanted %v", events[1].Error, ErrRestartVetoed)
+	}
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("ShouldRestart attempts => %v, wanted [1 2 3]", attempts)
+	}
+
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	if len(attempts) != 3 {
+		t.Errorf("ShouldRestart called for a Start command, wanted it only for automatic restarts")
+	}
+}
+
+func TestReapedElsewhere(t *testing.T) {
+	defer func(read func(int) (byte, error)) { readProcessState = read }(readProcessState)
+	tests := []struct {
+		alive   int32         // How many times the process is found running after Wait fails.
+		elapsed time.Duration // The least time before Exited.
+	}{
+		{3, 200 * time.Millisecond},
+		{math.MaxInt32, 300 * time.Millisecond}, // The pid was reused, so only StopTimeout ends the wait.
+	}
+	for _, test := range tests {
+		var reads atomic.Int32
+		readProcessState = func(int) (byte, error) {
+			if reads.Add(1) > test.alive {
+				return 'Z', nil
+			}
+			return 'S', nil
+		}
+
+		reaped := newFakeRunner(100)
+		svc, _ := NewService([]string{"server"})
+		svc.StartTimeout = 10 * time.Millisecond
+		svc.StopTimeout = 300 * time.Millisecond
+		svc.StopRestart = false
+		svc.CommandFactory = fakeFactory(reaped)
+
+		h := run(t, svc)
+		h.send(Start)
+		h.expect(Starting, Running)
+		h.response()
+		start := time.Now()
+		reaped.Exit(fmt.Errorf("wait: %w", syscall.ECHILD))
+		h.expect(Exited)
+		if elapsed := time.Since(start); elapsed < test.elapsed || elapsed > 2*time.Second {
+			t.Errorf("Exited after %s with the process running for %d reads, wanted at least %s", elapsed, test.alive, test.elapsed)
+		}
+		h.shutdown()
+	}
+}
+
+func TestUninterruptible(t *testing.T) {
+	defer func(read func(int) (byte, error)) { readProcessState = read }(readProcessState)
+	readProcessState = func(int) (byte, error) { return 'D', nil }
+
+	stuck := newFakeRunner(100)
+	stuck.immune = true
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.StopTimeout = 50 * time.Millisecond
+	svc.CommandFactory = fakeFactory(stuck)
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Stop)
+	events := h.expect(Stopping, Fatal)
+	if !errors.Is(events[1].Error, ErrUninterruptible) {
+		t.Errorf("event.Error => %v, wanted %v", events[1].Error, ErrUninterruptible)
+	}
+	if response := h.response(); !errors.Is(response.Error, ErrUninterruptible) {
+		t.Errorf("response.Error => %v, wanted %v", response.Error, ErrUninterruptible)
+	}
+	select {
+	case <-svc.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return for an uninterruptible process")
+	}
+
+	// The process finally exiting must not disturb the returned Run.
+	stuck.immune = false
+	stuck.Exit(nil)
+	time.Sleep(50 * time.Millisecond)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC) // A Wednesday.
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"@every 90s", from.Add(90 * time.Second)},
+		{"* * * * *", time.Date(2024, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 4 * * *", time.Date(2024, time.February, 1, 4, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"30 2 29 2 *", time.Date(2024, time.February, 29, 2, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2024, time.January, 31, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) => %s, wanted nil", test.spec, err)
+			continue
+		}
+		if next := schedule.next(from); !next.Equal(test.next) {
+			t.Errorf("parseSchedule(%q).next(%s) => %s, wanted %s", test.spec, from, next, test.next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every", "@every -1s", "@often"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) => nil, wanted an error", spec)
+		}
+	}
+}
+
+func TestRestartSchedule(t *testing.T) {
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.RestartSchedule = "@every 1s"
+	svc.CommandFactory = fakeFactory(newFakeRunner(100), newFakeRunner(101), newFakeRunner(102))
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	running := h.expect(Starting, Running)[1]
+	h.response()
+
+	// An operator restart does not move the scheduled restart.
+	time.Sleep(500 * time.Millisecond)
+	h.send(Restart)
+	restarted := h.expect(Stopping, Stopped, Starting, Running)[3]
+	h.response()
+
+	stopping := h.expect(Stopping)[0]
+	if stopping.Error == nil {
+		t.Errorf("event.Error => nil, wanted the scheduled restart")
+	}
+	if elapsed := time.Since(running.StartedAt); elapsed < time.Second {
+		t.Errorf("restarted on schedule after %s, wanted 1s", elapsed)
+	}
+	if time.Since(restarted.StartedAt) >= time.Second {
+		t.Errorf("restarted on schedule 1s after the operator restart, wanted 1s after the first start")
+	}
+	h.expect(Stopped, Starting, Running)
+}
+
+func TestRestartScheduleInvalid(t *testing.T) {
+	svc, _ := NewService([]string{"server"})
+	svc.RestartSchedule = "every day"
+	svc.CommandFactory = fakeFactory(newFakeRunner(100))
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the schedule rejected")
+	}
+}
+
+func TestRestartScheduleConfigureInvalid(t *testing.T) {
+	runner := newFakeRunner(100)
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.RestartPolicy = RestartAlways
+	svc.CommandFactory = fakeFactory(runner)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// The automatic restart has no response to fail, so it fails the service.
+	svc.Configure(func(svc *Service) {
+		svc.RestartSchedule = "every day"
+	})
+	runner.Exit(errors.New("exit status 1"))
+	h.expect(Exited)
+	if fatal := h.expect(Fatal)[0]; fatal.Error == nil {
+		t.Errorf("event.Error => nil, wanted the schedule error")
+	}
+}
@@ -1,58 +1,149 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
 	// Service defaults.
-	DefaultStartTimeout = 1 * time.Second
-	DefaultStartRetries = 3
-	DefaultStopSignal   = syscall.SIGINT
-	DefaultStopTimeout  = 5 * time.Second
-	DefaultStopRestart  = true
-
-	// Service commands.
-	Start    = "start"
-	Stop     = "stop"
-	Restart  = "restart"
-	Shutdown = "shutdown"
-
-	// Service states.
-	Starting = "starting"
-	Running  = "running"
-	Stopping = "stopping"
-	Stopped  = "stopped"
-	Exited   = "exited"
-	Backoff  = "backoff"
-	Fatal    = "fatal"
+	DefaultStartTimeout            = 1 * time.Second
+	DefaultStartRetries            = 3
+	DefaultStopTimeout             = 5 * time.Second
+	DefaultStopRestart             = true
+	DefaultDrainTimeout            = 30 * time.Second
+	DefaultDrainInterval           = 1 * time.Second
+	DefaultReadinessInterval       = 100 * time.Millisecond
+	DefaultCleanupTimeout          = 10 * time.Second
+	DefaultRestartOnOutputDebounce = 30 * time.Second
+	DefaultBackoffInitial          = 1 * time.Second
+	DefaultBackoffMax              = 60 * time.Second
+	DefaultBackoffFactor           = 2.0
+	DefaultHealthyAfter            = 30 * time.Second
+	DefaultBinaryStableTimeout     = 30 * time.Second
 )
 
+// CommandName identifies the action a Command performs.
+type CommandName string
+
+// Service commands.
+const (
+	Start    CommandName = "start"
+	Stop     CommandName = "stop" // Stops the process. A process which is Starting is stopped once its start succeeds or fails.
+	Restart  CommandName = "restart"
+	Shutdown CommandName = "shutdown"
+	Query    CommandName = "query"  // Responds with the State of the service without changing it.
+	Reload   CommandName = "reload" // Sends ReloadSignal to the running process without changing its state.
+)
+
+// commandNames lists every valid CommandName.
+var commandNames = []CommandName{Start, Stop, Restart, Shutdown, Query, Reload}
+
+// State is the state of a Service.
+type State string
+
+// Service states.
+const (
+	Starting State = "starting"
+	Running  State = "running"
+	Stopping State = "stopping"
+	Stopped  State = "stopped"
+	Exited   State = "exited"
+	Backoff  State = "backoff"
+	Fatal    State = "fatal"
+)
+
+// RestartPolicy decides whether a process which exits on its own is restarted.
+type RestartPolicy string
+
+// Restart policies.
+const (
+	RestartNever     RestartPolicy = "never"      // Never restart the process.
+	RestartOnFailure RestartPolicy = "on-failure" // Restart the process if it exits with failure.
+	RestartAlways    RestartPolicy = "always"     // Always restart the process.
+)
+
+// Probe checks whether the process of a Service is ready, for example by
+// connecting to the port it listens on. It returns nil once the process is
+// ready. The service stops waiting when ctx expires, so a probe which may
+// block should give up by then.
+type Probe func(ctx context.Context, svc *Service) error
+
+// RestartFunc decides whether a process which exited with exitErr and code
+// is restarted automatically. attempt counts the automatic restarts since the
+// process was last healthy, starting at 1.
+type RestartFunc func(exitErr error, code int, attempt int) bool
+
+// ErrUnknownCommand is returned in the Response to a Command with a name the
+// service does not recognize.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// ErrBusy is returned in the Response to a Command sent while another command
+// is executing.
+var ErrBusy = errors.New("service is busy")
+
+// ErrSlowStop is the error of the extra Stopping event sent when the process
+// is still running StopWarnAfter into stopping it.
+var ErrSlowStop = errors.New("process is slow to stop")
+
+// ErrUninterruptible is the error of the Fatal event sent when a process is
+// still in uninterruptible sleep StopTimeout after it was killed. Run returns
+// without waiting for it.
+var ErrUninterruptible = errors.New("process is in uninterruptible sleep")
+
+// ErrRestartVetoed is the error of the Fatal event sent when ShouldRestart
+// prevents an automatic restart.
+var ErrRestartVetoed = errors.New("restart vetoed by ShouldRestart")
+
 // Command is sent to a Service to initiate a state change.
 type Command struct {
-	Name     string
-	Response chan<- Response
+	Name        CommandName
+	Response    chan<- Response
+	Intentional bool   // Marks a Stop or Shutdown as deliberate so its Stopped event can be ignored by alerting.
+	Actor       string // Who issued the command, for auditing. Carried to the Response and to the events the command causes.
+	ID          string // Identifies the command to the caller, for example to match responses on a shared channel. Carried to the Response.
 }
 
-// respond creates and sends a command Response.
-func (cmd Command) respond(service *Service, err error) {
+// respond sends a Response to the command and passes both to the service's
+// OnCommand hook.
+func (cmd Command) respond(response Response) {
+	response.Name = cmd.Name
+	response.Actor = cmd.Actor
+	response.ID = cmd.ID
+	if svc := response.Service; svc != nil {
+		svc.config.Lock()
+		hook := svc.OnCommand
+		svc.config.Unlock()
+		if hook != nil {
+			hook(cmd, response)
+		}
+	}
 	if cmd.Response != nil {
-		cmd.Response <- Response{service, cmd.Name, err}
+		cmd.Response <- response
 	}
 }
 
 // Response contains the result of a Command.
 type Response struct {
-	Service *Service
-	Name    string
-	Error   error
+	Service  *Service
+	Name     CommandName
+	Error    error
+	Forced   bool           // True if the process had to be killed because it ignored the stop signal.
+	ExitCode int            // The exit code of the process if the command left it exited. -1 if it was killed by a signal or has no exit status.
+	Signal   syscall.Signal // The signal that killed the process, if any.
+	Actor    string         // The Actor of the command.
+	ID       string         // The ID of the command.
+	State    State          // The state of the service in the response to Query.
 }
 
 // Success returns True if the Command was successful.
@@ -60,111 +151,759 @@ func (r Response) Success() bool {
 	return r.Error == nil
 }
 
-// Event is sent by a Service on a state change.
+// Event is sent by a Service on a state change, and on each failed readiness
+// probe while Starting if ReadinessEvents is set. Events are not sent between
+// SuspendEvents and ResumeEvents.
 type Event struct {
-	Service *Service // The service from which the event originated.
-	State   string   // The new state of the service.
-	Error   error    // An error indicating why the service is in Exited or Backoff.
+	Service         *Service          // The service from which the event originated.
+	State           State             // The new state of the service.
+	Error           error             // An error indicating why the service is in Exited or Backoff, why it is Stopping on its own or slowly, or a *ProbeError on a Starting event for a failed readiness probe.
+	Labels          map[string]string // The labels of the service. Must not be modified.
+	Intentional     bool              // True on a Stopped event caused by an Intentional Stop or Shutdown command.
+	Actor           string            // The Actor of the command which caused the event, if any.
+	ExitCode        int               // On a Stopped, Exited, Backoff or Fatal event, the exit code of the process. -1 if it was killed by a signal or has no exit status, such as when it failed to start.
+	Signal          syscall.Signal    // On a Stopped, Exited, Backoff or Fatal event, the signal that killed the process, if any.
+	StartedAt       time.Time         // On a Running event, when the process entered Running.
+	Restarts        int               // On a Running event, the number of times the process has been started again after it exited or backed off.
+	CommandRestarts int               // On a Running event, the number of times the process has been restarted by a Restart command.
+	Suppressed      int               // On the event sent after ResumeEvents, the number of events dropped while suspended.
+}
+
+// ProbeError is the Error of the Starting event sent for a failed readiness
+// probe when ReadinessEvents is set.
+type ProbeError struct {
+	Probe string // The kind of probe which failed, such as "readiness".
+	Err   error  // The error returned by the probe.
+}
+
+// Error returns a description of the probe failure.
+func (err *ProbeError) Error() string {
+	return fmt.Sprintf("%s failing: %s", err.Probe, err.Err)
+}
+
+// Unwrap returns the error returned by the probe.
+func (err *ProbeError) Unwrap() error {
+	return err.Err
+}
+
+// Credential is the user and groups to run the process as.
+type Credential struct {
+	Uid    uint32   // The user ID.
+	Gid    uint32   // The primary group ID.
+	Groups []uint32 // Supplementary group IDs.
+}
+
+// StopStep is a signal to send when stopping the process and how long to wait
+// for it to exit before the next step.
+type StopStep struct {
+	Signal syscall.Signal
+	Wait   time.Duration
 }
 
 // ExitError indicated why the service entered an Exited or Backoff state.
-type ExitError string
+type ExitError struct {
+	Message string // A description of how the process exited.
+	Err     error  // The error returned by waiting on the process. Nil if it exited with success.
+}
 
 // Error returns the error message of the ExitError.
 func (err ExitError) Error() string {
-	return string(err)
+	return err.Message
+}
+
+// Unwrap returns the underlying error, typically an *exec.ExitError.
+func (err ExitError) Unwrap() error {
+	return err.Err
+}
+
+// failed returns true if err reports that the process exited with failure or
+// could not be started.
+func failed(err error) bool {
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Err != nil
+	}
+	return err != nil
+}
+
+// exitStatus returns the exit code of the process that err reports on and
+// the signal that killed it, if any. The code is 0 when the process exited
+// with success, and -1 when it was killed by a signal or err has no exit
+// status, for example because the process failed to start.
+func exitStatus(err error) (code int, signal syscall.Signal) {
+	if !failed(err) {
+		return 0, 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1, 0
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signal = status.Signal()
+	}
+	return exitErr.ExitCode(), signal
 }
 
 // Service represents a controllable process. Exported fields may be set to configure the service.
 type Service struct {
-	Directory    string                       // The process's working directory. Defaults to the current directory.
-	Environment  []string                     // The environment of the process. Defaults to nil which indicates the current environment.
-	StartTimeout time.Duration                // How long the process has to run before it's considered Running.
-	StartRetries int                          // How many times to restart a process if it fails to start. Defaults to 3.
-	StopSignal   syscall.Signal               // The signal to send when stopping the process. Defaults to SIGINT.
-	StopTimeout  time.Duration                // How long to wait for a process to stop before sending a SIGKILL. Defaults to 5s.
-	StopRestart  bool                         // Whether or not to restart the process if it exits unexpectedly. Defaults to true.
-	Stdout       io.Writer                    // Where to send the process's stdout. Defaults to /dev/null.
-	Stderr       io.Writer                    // Where to send the process's stderr. Defaults to /dev/null.
-	CommandHook  func(*Service, string) error // Function to call before executing a command. Will cancel the command on error.
-	args         []string                     // The command line of the process to run.
-	command      *exec.Cmd                    // The os/exec command running the process.
-	state        string                       // The state of the Service.
-}
-
-// New creates a new service with the default configution.
-func NewService(args []string) (svc *Service, err error) {
-	if cwd, err := os.Getwd(); err == nil {
-		svc = &Service{
-			cwd,
-			nil,
-			DefaultStartTimeout,
-			DefaultStartRetries,
-			DefaultStopSignal,
-			DefaultStopTimeout,
-			DefaultStopRestart,
-			nil,
-			nil,
-			nil,
-			args,
-			nil,
-			Stopped,
-		}
-	}
-	return
-}
-
-// State gets the current state of the service.
-func (s Service) State() string {
+	Directory               string                               // The process's working directory. Defaults to the current directory. Empty inherits the parent's.
+	Labels                  map[string]string                    // Labels such as environment or team attached to events. Keep the set of distinct values small.
+	Logger                  *slog.Logger                         // When set, state transitions, signals, starts, exits and backoffs are logged to it. Defaults to nil which logs nothing.
+	Metrics                 Metrics                              // When set, receives the service's state, restarts, start failures and start time, for example to export them to Prometheus. Defaults to nil.
+	Environment             []string                             // The environment of the process. Defaults to nil which indicates the current environment. See InheritEnvironment.
+	InheritEnvironment      bool                                 // Whether Environment is merged over the current environment rather than replacing it. Defaults to true.
+	ExpandEnvironment       bool                                 // Whether $VAR and ${VAR} in the args and Environment values are expanded from the environment on each start. Defaults to false.
+	StrictExpand            bool                                 // When ExpandEnvironment is set, whether starting fails on a variable that is not set rather than expanding it to empty.
+	ProcessTitle            string                               // When set, replaces argv[0] of the process so that ps shows it. See makeCommand.
+	StartTimeout            time.Duration                        // How long the process has to run before it's considered Running, counted from when it has started. Defaults to 1s.
+	StartTimeoutAtLaunch    bool                                 // Whether StartTimeout instead counts from before the process is launched, including fork and exec time. Defaults to false.
+	StartRetries            int                                  // How many times to restart a process if it fails to start. Defaults to 3.
+	ReadinessProbe          Probe                                // When set, polled while Starting with a context which expires at the end of StartTimeout. The process is Running once it returns nil, or is killed and backs off if it fails until StartTimeout.
+	ReadinessInterval       time.Duration                        // How often to poll ReadinessProbe. Defaults to 100ms, which is also used if it is zero or less.
+	ReadinessEvents         bool                                 // Whether a Starting event with a *ProbeError is sent each time ReadinessProbe fails. Defaults to false.
+	HandoverSignal          syscall.Signal                       // When set, a Restart while Running sends this signal for the process to hand over to a new generation of itself in place instead of being stopped and started. See waitHandover.
+	HandoverProbe           Probe                                // When set, polled after HandoverSignal until it returns nil to confirm the handover. Defaults to ReadinessProbe.
+	MaxBackoffTime          time.Duration                        // When non-zero, how long a crash loop may continue before the service goes Fatal regardless of StartRetries.
+	HealthyAfter            time.Duration                        // How long the process must stay Running before its start retries are reset. Zero resets them as soon as it is Running. Defaults to 30s.
+	BackoffInitial          time.Duration                        // How long to wait before the first retry after a Backoff. Defaults to 1s.
+	BackoffMax              time.Duration                        // The longest wait between retries. Defaults to 60s.
+	BackoffFactor           float64                              // How much the wait grows with each retry. Defaults to 2.0.
+	BackoffFloor            time.Duration                        // The minimum wait before every retry, added to the growing wait. Defaults to 0.
+	StopSignal              syscall.Signal                       // The signal to send when stopping the process. Defaults to SIGINT.
+	ReloadSignal            syscall.Signal                       // The signal sent by a Reload command. Defaults to SIGHUP on Unix and to none elsewhere. Reload fails rather than sending it if it is also StopSignal or one of StopSignals.
+	StopTimeout             time.Duration                        // How long to wait for a process to stop before sending a SIGKILL. Defaults to 5s.
+	StopWarnAfter           time.Duration                        // When non-zero, how long the process may take to stop before a Stopping event with ErrSlowStop warns that it is slow. Defaults to 0.
+	StopSignals             []StopStep                           // When set, the signals to send in turn when stopping the process instead of StopSignal and StopTimeout. The process is killed if it is alive after the last step.
+	KillSignal              syscall.Signal                       // The signal sent when the process does not stop in time. Defaults to SIGKILL. Any other signal may leave the process alive, in which case stopping does not guarantee termination.
+	ProcessGroup            bool                                 // Whether to run the process in its own process group and send stop and kill signals to the whole group. Defaults to false.
+	Credential              *Credential                          // When set, the user and groups to run the process as. Starting fails unless the service may switch to them, e.g. when running as root.
+	CloseOnExec             bool                                 // Whether to mark all of the supervisor's descriptors close-on-exec before starting the process so none leak into it. Stdio and ExtraFiles are still passed. Defaults to false.
+	StopRestart             bool                                 // Whether or not to restart the process if it exits unexpectedly when RestartPolicy is not set. Defaults to true.
+	RestartPolicy           RestartPolicy                        // When set, whether to restart the process if it exits unexpectedly. Overrides StopRestart.
+	ShouldRestart           RestartFunc                          // When set, called before each automatic restart. Returning false sends the service to Fatal instead.
+	Stdout                  io.Writer                            // Where to send the process's stdout. Defaults to /dev/null.
+	Stderr                  io.Writer                            // Where to send the process's stderr. Defaults to /dev/null.
+	Stdin                   io.Reader                            // The process's stdin. Defaults to /dev/null. A reader is consumed by the first start, so use StdinFactory if the process may be restarted.
+	StdinFactory            func() io.Reader                     // When set, called for a fresh standard input on each start instead of using Stdin.
+	ExtraFiles              []*os.File                           // Open files passed to the process as descriptors 3 and up.
+	OutputRateLimit         int                                  // When non-zero, the bytes per second forwarded to each of Stdout and Stderr.
+	OutputDrop              bool                                 // Whether to drop output over OutputRateLimit rather than making the process wait.
+	RestartOnOutput         []string                             // Regular expressions matched against each line of output. A match restarts the Running process.
+	RestartOnOutputDebounce time.Duration                        // The minimum time between restarts caused by RestartOnOutput. Defaults to 30s.
+	CaptureOutput           bool                                 // Whether to make lines of output available to StreamOutput.
+	CommandHook             func(*Service, CommandName) error    // Function to call before executing a command. Will cancel the command on error.
+	OnCommand               func(cmd Command, response Response) // When set, called with each command and its response to keep an audit trail. Called from Run, so it must not block.
+	CommandFactory          func(args []string) Runner           // Creates the process to run. Defaults to nil which runs args with os/exec.
+	DrainProbe              func(*Service) error                 // Polled before stopping. The stop signal is withheld until it returns nil or DrainTimeout elapses.
+	DrainTimeout            time.Duration                        // How long to wait for DrainProbe to succeed. Defaults to 30s.
+	DrainInterval           time.Duration                        // How often to poll DrainProbe. Defaults to 1s.
+	OnForceKill             func(pid int)                        // Called in its own goroutine when a process ignoring the stop signal has to be killed.
+	OnOutputFallback        func(err error)                      // Called in its own goroutine when the output pipes can't be created and the process is started with plain output instead. See execRunner.Start.
+	OnStdinError            func(err error)                      // Called when reading Stdin fails. The process's stdin is closed so that it reads EOF either way.
+	BinaryStable            time.Duration                        // When non-zero, wait for the binary to be executable and unchanged for this long before starting.
+	BinaryStableTimeout     time.Duration                        // How long to wait for the binary to become stable before the start backs off with ErrUnstableBinary. Defaults to 30s.
+	SanitizeEnv             bool                                 // Whether to remove the variables in SanitizeDeny from the process's environment.
+	SanitizeDeny            []string                             // The variables removed by SanitizeEnv. Defaults to DefaultSanitizeDeny.
+	SanitizePath            string                               // When SanitizeEnv is set and this is not empty, replaces the process's PATH.
+	CleanupCommand          []string                             // A command run in the background after the process is Stopped, Exited or Fatal, but not when it is stopped to be restarted. Failure is logged.
+	CleanupTimeout          time.Duration                        // How long CleanupCommand may run before it is killed. Defaults to 10s, which is also used if it is zero or less.
+	FatalCooldown           time.Duration                        // When non-zero, how long to wait after Fatal before retrying the start. Defaults to 0 which stays Fatal.
+	PidFile                 string                               // When set, the PID of the process is written to this file while it is Running. Failure to write or remove it is ignored.
+	Orphans                 OrphanPolicy                         // When set with PidFile, what Run does on starting if the PID in PidFile belongs to a process left running by a previous supervisor. An adopted process goes through Starting to Running without being started again, and its output is not captured.
+	RestartBudget           *RestartBudget                       // When set, limits how often the process is restarted automatically.
+	RestartSchedule         string                               // When set, a cron expression, macro such as @daily, or @every interval at which a Running process is restarted. See parseSchedule.
+	args                    []string                             // The command line of the process to run.
+	rollback                string                               // The binary replaced by SwapBinary.
+	rolledBack              chan<- struct{}                      // Notifies Run that Rollback restored the previous binary. Protected by mutex.
+	done                    chan struct{}                        // Closed when Run returns.
+	doneRun                 bool                                 // Whether done belongs to a call to Run.
+	dropped                 atomic.Int64                         // The number of output bytes dropped.
+	outputMatch             chan<- string                        // Receives lines of output matching RestartOnOutput.
+	streams                 map[chan string]bool                 // The channels returned by StreamOutput. Protected by mutex.
+	suspended               bool                                 // Whether events are suspended. Protected by mutex.
+	resume                  chan struct{}                        // Notifies Run that events were resumed. Protected by mutex.
+	mutex                   sync.Mutex                           // Protects args, rollback, rolledBack, done, streams, nextRestart, suspended and resume.
+	stateMutex              sync.RWMutex                         // Protects state, command, pending, startedAt and the restart counters. Only Run and the goroutines it starts write them.
+	config                  sync.Mutex                           // Held by Configure and while Run takes a snapshot of the settings.
+	command                 Runner                               // The running process.
+	state                   State                                // The state of the Service.
+	pending                 CommandName                          // The name of the command being executed.
+	pendingSince            time.Time                            // When the pending command was received.
+	startedAt               time.Time                            // When the process last entered Running. Protected by stateMutex.
+	restarts                int                                  // The number of automatic restarts after an exit or backoff. Protected by stateMutex.
+	commandRestarts         int                                  // The number of restarts by a Restart command. Protected by stateMutex.
+	nextRestart             time.Time                            // When the delayed start is due, or zero if none is scheduled. Protected by mutex.
+}
+
+// New creates a new service with the default configution. It returns an error
+// if args is empty. Directory defaults to the current directory, or is left
+// empty to inherit it if the current directory can't be determined.
+func NewService(args []string) (*Service, error) {
+	if len(args) == 0 {
+		return nil, errors.New("service command is empty")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = ""
+	}
+	return &Service{
+		Directory:               cwd,
+		StartTimeout:            DefaultStartTimeout,
+		StartRetries:            DefaultStartRetries,
+		StopSignal:              DefaultStopSignal,
+		ReloadSignal:            DefaultReloadSignal,
+		StopTimeout:             DefaultStopTimeout,
+		KillSignal:              DefaultKillSignal,
+		StopRestart:             DefaultStopRestart,
+		InheritEnvironment:      true,
+		DrainTimeout:            DefaultDrainTimeout,
+		DrainInterval:           DefaultDrainInterval,
+		ReadinessInterval:       DefaultReadinessInterval,
+		SanitizeDeny:            append([]string(nil), DefaultSanitizeDeny...),
+		CleanupTimeout:          DefaultCleanupTimeout,
+		RestartOnOutputDebounce: DefaultRestartOnOutputDebounce,
+		BackoffInitial:          DefaultBackoffInitial,
+		BackoffMax:              DefaultBackoffMax,
+		BackoffFactor:           DefaultBackoffFactor,
+		HealthyAfter:            DefaultHealthyAfter,
+		args:                    args,
+		state:                   Stopped,
+	}, nil
+}
+
+// State gets the current state of the service. It is safe to call from any
+// goroutine, but Run may change the state as soon as it returns. Send a Query
+// command to read the state in order with other commands.
+func (s *Service) State() State {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
 	return s.state
 }
 
-// Pid gets the PID of the service or 0 if not Running or Stopping.
-func (s Service) Pid() int {
+// setPending sets the name of the command being executed, or clears it if
+// name is empty.
+func (s *Service) setPending(name CommandName) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.pending = name
+	s.pendingSince = time.Now()
+}
+
+// setState sets the state of the service.
+func (s *Service) setState(state State) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if state == Running && s.state != Running {
+		s.startedAt = time.Now()
+	}
+	s.state = state
+}
+
+// Restarts gets the number of times the process has been started again after
+// it exited or backed off, not counting restarts requested with commands.
+func (s *Service) Restarts() int {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.restarts
+}
+
+// CommandRestarts gets the number of times the process has been restarted by
+// a Restart command.
+func (s *Service) CommandRestarts() int {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.commandRestarts
+}
+
+// countRestart increments the restart counter of a commanded or automatic
+// restart and reports it to metrics if it is set.
+func (s *Service) countRestart(metrics Metrics, commanded bool) {
+	s.stateMutex.Lock()
+	if commanded {
+		s.commandRestarts++
+	} else {
+		s.restarts++
+	}
+	s.stateMutex.Unlock()
+	if metrics != nil {
+		metrics.AddRestart(s, commanded)
+	}
+}
+
+// SuspendEvents stops the service sending events until ResumeEvents is
+// called. The service otherwise carries on as normal: commands are answered
+// and the state can still be read with State or a Query command. The events
+// sent while suspended are dropped.
+func (s *Service) SuspendEvents() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.suspended = true
+}
+
+// ResumeEvents resumes sending events after SuspendEvents. If any events were
+// dropped, Run sends an event with the current state and the number dropped in
+// Suppressed.
+func (s *Service) ResumeEvents() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.suspended {
+		return
+	}
+	s.suspended = false
+	select {
+	case s.resumeChannel() <- struct{}{}:
+	default:
+	}
+}
+
+// eventsSuspended returns true if events are suspended.
+func (s *Service) eventsSuspended() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.suspended
+}
+
+// resumeChannel returns the channel on which ResumeEvents notifies Run. Must
+// be called with mutex held.
+func (s *Service) resumeChannel() chan struct{} {
+	if s.resume == nil {
+		s.resume = make(chan struct{}, 1)
+	}
+	return s.resume
+}
+
+// StartedAt gets when the process last entered Running, or the zero time if
+// it is not Running or Stopping.
+func (s *Service) StartedAt() time.Time {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
 	if s.state != Running && s.state != Stopping {
+		return time.Time{}
+	}
+	return s.startedAt
+}
+
+// Uptime gets how long the process has been Running, or 0 if it is not
+// Running or Stopping.
+func (s *Service) Uptime() time.Duration {
+	startedAt := s.StartedAt()
+	if startedAt.IsZero() {
 		return 0
 	}
-	return s.command.Process.Pid
+	return time.Since(startedAt)
 }
 
-func (s Service) makeCommand() *exec.Cmd {
-	cmd := exec.Command(s.args[0], s.args[1:]...)
-	cmd.Stdout = s.Stdout
-	cmd.Stderr = s.Stderr
-	cmd.Stdin = nil
-	cmd.Env = s.Environment
+// process returns the process if the service is Running or Stopping, or nil
+// otherwise.
+func (s *Service) process() Runner {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	if s.state != Running && s.state != Stopping {
+		return nil
+	}
+	return s.command
+}
+
+// PendingCommand gets the name of the command currently being executed and
+// when it was received, or an empty name if no command is executing.
+func (s *Service) PendingCommand() (CommandName, time.Time) {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	if s.pending == "" {
+		return "", time.Time{}
+	}
+	return s.pending, s.pendingSince
+}
+
+// IsAlive returns true if the process is Running or Stopping and still
+// exists. It probes the process with signal 0 so it does not rely on /proc.
+func (s *Service) IsAlive() bool {
+	process := s.process()
+	if process == nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// AllowedCommands gets the commands which may be executed in the current state.
+// It follows the rules Run enforces: Query and Shutdown are always allowed,
+// Stop and Reload only while Running, and Restart from Fatal as well as from
+// Running, Stopped and Exited.
+func (s *Service) AllowedCommands() []CommandName {
+	state := s.State()
+	commands := []CommandName{}
+	for _, command := range commandNames {
+		if allowed(command, state) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// valid returns true if the name is one of the service commands.
+func (name CommandName) valid() bool {
+	for _, command := range commandNames {
+		if name == command {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns true if the named command may be executed from the given state.
+func allowed(command CommandName, state State) bool {
+	switch command {
+	case Start:
+		return state == Stopped || state == Exited || state == Backoff || state == Fatal
+	case Stop:
+		return state == Running || state == Starting || state == Backoff
+	case Reload:
+		return state == Running
+	case Restart:
+		return state == Running || state == Stopped || state == Exited || state == Fatal
+	case Shutdown, Query:
+		return true
+	}
+	return false
+}
+
+// Pid gets the PID of the service or 0 if not Running or Stopping.
+func (s *Service) Pid() int {
+	process := s.process()
+	if process == nil {
+		return 0
+	}
+	return process.Pid()
+}
+
+// Configure calls fn to change the settings of the service while it may be
+// running. Run takes a snapshot of the settings while holding the same lock
+// as each start, stop or handover of the process begins, and uses it until
+// the next, so changes take effect the next time the process is started or
+// stopped. For example, changing StopSignal applies to the next Stop, and
+// changing StartTimeout to the next start. Settings used by a command, such
+// as CommandHook and ReloadSignal, are read as the command is received.
+func (s *Service) Configure(fn func(*Service)) {
+	s.config.Lock()
+	defer s.config.Unlock()
+	fn(s)
+}
+
+// makeCommand creates the command to start the process. A ProcessTitle is
+// applied by replacing argv[0] since Go provides no way to call
+// prctl(PR_SET_NAME) in the child before exec. This changes the command line
+// shown by ps but not the kernel's thread name (comm), which remains the
+// binary's file name truncated to 15 characters. The process group and
+// credential are taken from cfg, which the process is signalled with.
+func (s *Service) makeCommand(cfg *settings) (*exec.Cmd, error) {
+	s.config.Lock()
+	defer s.config.Unlock()
+
+	args, env := s.argv(), s.environment()
+	if s.ExpandEnvironment {
+		var err error
+		if args, env, err = expandEnv(args, env, s.StrictExpand); err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if s.ProcessTitle != "" {
+		cmd.Args[0] = s.ProcessTitle
+	}
+
+	patterns, err := s.outputPatterns()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr := s.sharedOutput(s.Stdout, s.Stderr)
+	cmd.Stdout = s.output(stdout, patterns)
+	cmd.Stderr = s.output(stderr, patterns)
+	cmd.Stdin = s.Stdin
+	if s.StdinFactory != nil {
+		cmd.Stdin = s.StdinFactory()
+	}
+	cmd.Env = env
 	cmd.Dir = s.Directory
-	return cmd
+	cmd.ExtraFiles = s.ExtraFiles
+	if cfg.processGroup {
+		if err := setProcessGroup(cmd); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.credential != nil {
+		if err := setCredential(cmd, cfg.credential); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
 }
 
+// cleanup runs CleanupCommand and waits up to CleanupTimeout for it to
+// complete. A CleanupTimeout of zero or less uses DefaultCleanupTimeout.
+func (s *Service) cleanup() error {
+	s.config.Lock()
+	if len(s.CleanupCommand) == 0 {
+		s.config.Unlock()
+		return nil
+	}
+	timeout := s.CleanupTimeout
+	if timeout <= 0 {
+		timeout = DefaultCleanupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.CleanupCommand[0], s.CleanupCommand[1:]...)
+	cmd.Env = s.environment()
+	cmd.Dir = s.Directory
+	cmd.ExtraFiles = s.ExtraFiles
+	s.config.Unlock()
+	return cmd.Run()
+}
+
+// StopPlan returns the steps a Stop would take with the current
+// configuration without stopping anything. The last step is the KillSignal
+// sent if the process is still alive, which has no wait. A DrainProbe may
+// delay the first step by up to DrainTimeout.
+func (s *Service) StopPlan() []StopStep {
+	cfg := s.snapshot()
+	kill := cfg.killSignal
+	if kill == 0 {
+		kill = syscall.SIGKILL
+	}
+	return append(cfg.stopSteps, StopStep{kill, 0})
+}
+
+// waitReady waits up to timeout for the process to become ready by polling
+// the ReadinessProbe of cfg every ReadinessInterval, passing each failure to
+// failed. The probe's context expires with the timeout. Without a probe it
+// waits the full timeout. It returns the probe's last error if the process
+// did not become ready, or true if a value is received on exited first.
+func (s *Service) waitReady(cfg *settings, timeout time.Duration, exited <-chan bool, failed func(err error)) (bool, error) {
+	if cfg.readinessProbe == nil {
+		time.Sleep(timeout)
+		return false, nil
+	}
+	interval := cfg.readinessInterval
+	if interval <= 0 {
+		interval = DefaultReadinessInterval
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for {
+		err := cfg.readinessProbe(ctx, s)
+		if err == nil {
+			return false, nil
+		}
+		failed(err)
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, err
+		}
+		if remaining > interval {
+			remaining = interval
+		}
+		select {
+		case <-exited:
+			return true, nil
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// drain polls the DrainProbe of cfg until it succeeds or DrainTimeout
+// elapses.
+func (s *Service) drain(cfg *settings) {
+	if cfg.drainProbe == nil {
+		return
+	}
+	deadline := time.Now().Add(cfg.drainTimeout)
+	for cfg.drainProbe(s) != nil {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return
+		}
+		if remaining > cfg.drainInterval {
+			remaining = cfg.drainInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// Done returns a channel which is closed when Run returns. Events are sent
+// synchronously so every event, including the terminal one, has been received
+// from the events channel by the time Done is closed.
+func (s *Service) Done() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// Run manages the process, executing commands received on commands and
+// sending an event on events for each state change. It returns once a Shutdown
+// command has left the process in a terminal state. Events are sent without
+// buffering, so the caller must keep receiving them until Run returns.
 func (s *Service) Run(commands <-chan Command, events chan<- Event) {
+	s.RunContext(context.Background(), commands, events)
+}
+
+// NextRestart gets when the service will next try to start the process after
+// a Backoff, a Fatal cooldown or an exhausted RestartBudget, or the zero time
+// if no start is scheduled.
+func (s *Service) NextRestart() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nextRestart
+}
+
+// RunContext is like Run but also shuts down the service when ctx is
+// cancelled, stopping a running process with StopSignal and StopTimeout
+// before returning.
+func (s *Service) RunContext(ctx context.Context, commands <-chan Command, events chan<- Event) {
 	type ProcessState struct {
-		State string
+		State State
 		Error error
 	}
+	type HandoverResult struct {
+		ID    int
+		Error error
+	}
+	type ProbeFailure struct {
+		ID    int
+		Error error
+	}
+
+	rolledBack := make(chan struct{}, 1)
+	s.mutex.Lock()
+	resumed := s.resumeChannel()
+	s.rolledBack = rolledBack
+	if s.done == nil || s.doneRun {
+		s.done = make(chan struct{})
+	}
+	s.doneRun = true
+	done := s.done
+	s.mutex.Unlock()
+	defer close(done)
+	defer func() {
+		s.mutex.Lock()
+		s.rolledBack = nil
+		s.mutex.Unlock()
+	}()
 
 	var command *Command = nil
+	cfg := s.snapshot() // The settings of the current start or stop.
+	cancelled := ctx.Done()
 	states := make(chan ProcessState)
 	kill := make(chan int, 2)
+	delayed := make(chan int, 1)
+	delays := 0
+	healthy := make(chan int, 1)
+	healthies := 0
+	stuck := make(chan int, 1)
+	slow := make(chan int, 1)
+	handedOver := make(chan HandoverResult, 1)
+	handovers := 0
+	probeFailed := make(chan ProbeFailure)
+	starts := 0
+	abandoned := false
+	outputMatch := make(chan string, 1)
+	lastOutputRestart := time.Time{}
+	scheduled := time.NewTimer(time.Hour) // Fires when the restart at scheduledAt is due.
+	scheduled.Stop()
+	quit := make(chan struct{}) // Closed when Run returns so that pending timers and stops give up.
+	scheduledAt := time.Time{}  // When the next scheduled restart is due, kept across restarts.
+	suppressed := 0             // The number of events dropped since SuspendEvents.
+	restarting := false
+	restartPending := false     // Whether the next start is a restart, counted once the process is Starting.
+	restartCommanded := false   // Whether that restart was commanded.
+	adopted := s.reconcile(cfg) // An orphaned process for the first start to adopt.
 	retries := 0
+	attempts := 0 // Automatic restarts since the process was last healthy.
+	backoffSince := time.Time{}
+	forced := false
+	exitCode, exitSignal := 0, syscall.Signal(0)
 
+	s.outputMatch = outputMatch
+	// schedule records when the delayed start is due.
+	schedule := func(at time.Time) {
+		s.mutex.Lock()
+		s.nextRestart = at
+		s.mutex.Unlock()
+	}
+	defer schedule(time.Time{})
+	defer scheduled.Stop()
 	defer func() {
+		close(quit)
 		close(states)
-		close(kill)
+		close(handedOver)
 	}()
 
 	sendResponse := func(err error) {
 		if command != nil {
-			if command.Response != nil {
-				command.respond(s, err)
-			}
+			command.respond(Response{Service: s, Error: err, Forced: forced, ExitCode: exitCode, Signal: exitSignal})
 			command = nil
+			s.setPending("")
+		}
+		forced = false
+	}
+
+	// emit sends an event, or counts it as suppressed while events are
+	// suspended.
+	emit := func(event Event) {
+		if s.eventsSuspended() {
+			suppressed++
+		} else {
+			events <- event
+		}
+	}
+
+	// sendWarning sends an event for the current state carrying err without
+	// changing the state.
+	sendWarning := func(err error) {
+		event := Event{Service: s, State: s.state, Error: err, Labels: cfg.labels}
+		if command != nil {
+			event.Actor = command.Actor
 		}
+		emit(event)
 	}
 
-	sendEvent := func(state string, err error) {
-		s.state = state
-		events <- Event{s, state, err}
+	sendEvent := func(state State, err error) {
+		attrs := []any{"from", s.state, "to", state}
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		cfg.log(slog.LevelInfo, "state transition", attrs...)
+		s.setState(state)
+		s.updateMetrics(cfg.metrics, state)
+		s.updatePidFile(cfg.pidFile, state)
+		event := Event{Service: s, State: state, Error: err, Labels: cfg.labels}
+		if command != nil {
+			event.Actor = command.Actor
+		}
+		if state == Stopped || state == Exited || state == Backoff || state == Fatal {
+			event.ExitCode, event.Signal = exitCode, exitSignal
+		}
+		if state == Running {
+			event.StartedAt = s.StartedAt()
+			event.Restarts, event.CommandRestarts = s.Restarts(), s.CommandRestarts()
+		}
+		event.Intentional = state == Stopped && command != nil && command.Intentional && (command.Name == Stop || command.Name == Shutdown)
+		emit(event)
+
+		// The Stopped of a restart is not terminal, so it is not cleaned up.
+		restarted := state == Stopped && (command != nil && command.Name == Restart || restarting && (command == nil || command.Name != Shutdown))
+		if (state == Stopped || state == Exited || state == Fatal) && !restarted {
+			// Cleanup runs in the background so that it does not hold up
+			// commands and timers for up to CleanupTimeout.
+			go func(cfg *settings) {
+				if err := s.cleanup(); err != nil {
+					cfg.log(slog.LevelWarn, "cleanup command failed", "error", err)
+				}
+			}(cfg)
+		}
 
 		if command == nil {
 			return
@@ -188,20 +927,93 @@ func (s *Service) Run(commands <-chan Command, events chan<- Event) {
 		}
 	}
 
-	invalidStateError := func(state string) error {
+	invalidStateError := func(state State) error {
 		return errors.New(fmt.Sprintf("invalid state transition: %s -> %s", s.state, state))
 	}
 
+	// report sends the state of the process to Run. It may be called after
+	// Run has given up on an uninterruptible process and closed states.
+	report := func(state ProcessState) {
+		defer func() {
+			if err := recover(); err != nil {
+				if _, ok := err.(runtime.Error); !ok {
+					panic(err)
+				}
+			}
+		}()
+		states <- state
+	}
+
 	start := func() {
-		if s.state != Stopped && s.state != Exited && s.state != Backoff && s.state != Fatal {
+		if !allowed(Start, s.state) {
 			sendResponse(invalidStateError(Starting))
 			return
 		}
 
+		cfg = s.snapshot()
+		if cfg.restartSchedule != "" {
+			if _, err := parseSchedule(cfg.restartSchedule); err != nil {
+				if command == nil {
+					// An automatic start has no response to fail, so the
+					// error is reported in the event instead.
+					retries = 0
+					attempts = 0
+					sendEvent(Fatal, err)
+				}
+				sendResponse(err)
+				return
+			}
+		}
+		if command != nil && command.Name == Start {
+			// The schedule is paused while stopped and starts over.
+			scheduledAt = time.Time{}
+			scheduled.Stop()
+		}
+
+		delays++ // Cancel any delayed start.
+		schedule(time.Time{})
+		exitCode, exitSignal = 0, 0
+		if command == nil || command.Name != Restart {
+			forced = false
+		}
+		orphan := adopted
+		adopted = nil
+		starts++
+		id := starts
+		if restartPending {
+			restartPending = false
+			s.countRestart(cfg.metrics, restartCommanded)
+		}
 		sendEvent(Starting, nil)
-		go func() {
-			s.command = s.makeCommand()
-			if err := s.command.Start(); err == nil {
+		go func(cfg *settings) {
+			var err error
+			if orphan == nil {
+				err = s.waitStable(cfg)
+			}
+			launched := time.Now()
+			runner := orphan
+			if err == nil && runner == nil {
+				runner, err = s.makeRunner(cfg)
+			}
+			if err == nil {
+				s.stateMutex.Lock()
+				s.command = runner
+				s.stateMutex.Unlock()
+				err = runner.Start()
+			}
+			if err != nil {
+				cfg.log(slog.LevelError, "process failed to start", "error", err)
+			}
+			if err == nil {
+				droppedBefore := s.DroppedOutput()
+				cfg.log(slog.LevelInfo, "process started", "pid", runner.Pid())
+				timeout := cfg.startTimeout
+				if cfg.startTimeoutAtLaunch {
+					timeout -= time.Since(launched)
+				}
+				if timeout < 0 {
+					timeout = 0
+				}
 				waitOver := make(chan bool, 1)
 				checkOver := make(chan bool, 1)
 
@@ -210,19 +1022,52 @@ func (s *Service) Run(commands <-chan Command, events chan<- Event) {
 					close(checkOver)
 				}()
 
+				process := runner
+				var notReady error
 				go func() {
-					time.Sleep(s.StartTimeout)
+					exited, err := s.waitReady(cfg, timeout, waitOver, func(err error) {
+						if cfg.readinessEvents {
+							select {
+							case probeFailed <- ProbeFailure{id, &ProbeError{"readiness", err}}:
+							case <-quit:
+							}
+						}
+					})
+					if exited {
+						checkOver <- false
+						return
+					}
 					select {
 					case <-waitOver:
 						checkOver <- false
 					default:
-						states <- ProcessState{Running, nil}
-						checkOver <- true
+						if err != nil {
+							notReady = err
+							process.Kill() //TODO: Check for error.
+							checkOver <- false
+						} else {
+							report(ProcessState{Running, nil})
+							checkOver <- true
+						}
 					}
 				}()
 
-				exitErr := s.command.Wait()
+				exitErr := runner.Wait()
+				if errors.Is(exitErr, syscall.ECHILD) {
+					// The process was reaped by someone else. Make sure it
+					// is really gone before treating it as exited. One still
+					// running after StopTimeout is taken to be another
+					// process which reused the pid.
+					if !waitExit(runner.Pid(), cfg.stopTimeout) {
+						cfg.log(slog.LevelWarn, "pid of process reaped elsewhere is still running", "pid", runner.Pid())
+					}
+				}
 				waitOver <- true
+				code, signal := exitStatus(exitErr)
+				cfg.log(slog.LevelInfo, "process exited", "pid", runner.Pid(), "code", code, "signal", signal)
+				if dropped := s.DroppedOutput() - droppedBefore; dropped > 0 {
+					cfg.log(slog.LevelWarn, "dropped process output", "pid", runner.Pid(), "bytes", dropped)
+				}
 
 				msg := ""
 				if check := <-checkOver; check {
@@ -231,32 +1076,39 @@ func (s *Service) Run(commands <-chan Command, events chan<- Event) {
 					} else {
 						msg = fmt.Sprintf("process exited normally with failure: %s", exitErr)
 					}
-					states <- ProcessState{Exited, ExitError(msg)}
+					report(ProcessState{Exited, ExitError{msg, exitErr}})
 				} else {
-					if exitErr == nil {
+					if notReady != nil {
+						msg = fmt.Sprintf("process failed readiness probe: %s", notReady)
+					} else if exitErr == nil {
 						msg = "process exited prematurely with success"
 					} else {
 						msg = fmt.Sprintf("process exited prematurely with failure: %s", exitErr)
 					}
-					states <- ProcessState{Backoff, ExitError(msg)}
+					report(ProcessState{Backoff, ExitError{msg, exitErr}})
 				}
+			} else if transient(err) {
+				// Retry like a premature exit so a pending Start only
+				// fails once the retries are exhausted.
+				msg := fmt.Sprintf("process failed to start: %s", err)
+				report(ProcessState{Backoff, ExitError{msg, err}})
 			} else {
-				states <- ProcessState{Exited, err}
+				// Only retried, with backoff, if the restart policy
+				// restarts the process.
+				report(ProcessState{Exited, err})
 			}
-		}()
+		}(cfg)
 	}
 
-	stop := func() {
-		if s.state != Running {
-			sendResponse(invalidStateError(Stopping))
-			return
-		}
-
-		sendEvent(Stopping, nil)
-		pid := s.Pid()
-		s.command.Process.Signal(s.StopSignal) //TODO: Check for error.
-		go func() {
-			time.Sleep(s.StopTimeout)
+	// handover sends HandoverSignal to the running process and reports once
+	// it passes the handover probe, or fails to within StartTimeout.
+	handover := func() {
+		handovers++
+		id := handovers
+		process := s.command
+		cfg = s.snapshot()
+		sig, timeout := cfg.handoverSignal, cfg.startTimeout
+		go func(cfg *settings) {
 			defer func() {
 				if err := recover(); err != nil {
 					if _, ok := err.(runtime.Error); !ok {
@@ -264,69 +1116,301 @@ func (s *Service) Run(commands <-chan Command, events chan<- Event) {
 					}
 				}
 			}()
-			kill <- pid
+			err := process.Signal(sig)
+			if err == nil {
+				err = s.waitHandover(cfg, timeout)
+			}
+			if err != nil {
+				err = fmt.Errorf("handover failed: %w", err)
+			}
+			handedOver <- HandoverResult{id, err}
+		}(cfg)
+	}
+
+	// reload sends ReloadSignal to the running process.
+	reload := func() {
+		if !allowed(Reload, s.state) {
+			sendResponse(fmt.Errorf("cannot reload the process in state %s", s.state))
+			return
+		}
+		signal, err := s.snapshot().reload()
+		if err != nil {
+			sendResponse(err)
+			return
+		}
+		if err := s.command.Signal(signal); err != nil {
+			cfg.log(slog.LevelWarn, "failed to signal process", "pid", s.command.Pid(), "signal", signal, "error", err)
+			sendResponse(err)
+			return
+		}
+		cfg.log(slog.LevelInfo, "signaled process", "pid", s.command.Pid(), "signal", signal)
+		sendResponse(nil)
+	}
+
+	// after sends id on ch once delay has elapsed, unless Run returns first.
+	after := func(delay time.Duration, ch chan<- int, id int) {
+		go func() {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-quit:
+				return
+			}
+			select {
+			case ch <- id:
+			case <-quit:
+			}
 		}()
 	}
 
+	stop := func(reason error) {
+		if !allowed(Stop, s.state) {
+			sendResponse(invalidStateError(Stopping))
+			return
+		}
+
+		cfg = s.snapshot()
+		sendEvent(Stopping, reason)
+		forced = false
+		pid := s.Pid()
+		process := s.command
+		if cfg.stopWarnAfter > 0 {
+			after(cfg.stopWarnAfter, slow, pid)
+		}
+		go func(cfg *settings) {
+			s.drain(cfg)
+			for i, step := range cfg.stopSteps {
+				if i > 0 && process.Signal(syscall.Signal(0)) != nil {
+					return
+				}
+				if err := process.Signal(step.Signal); err != nil {
+					cfg.log(slog.LevelWarn, "failed to signal process", "pid", pid, "signal", step.Signal, "error", err)
+				} else {
+					cfg.log(slog.LevelInfo, "signaled process", "pid", pid, "signal", step.Signal)
+				}
+				time.Sleep(step.Wait)
+			}
+			select {
+			case kill <- pid:
+			case <-quit:
+			}
+		}(cfg)
+	}
+
 	shouldShutdown := func() bool {
 		return command != nil && command.Name == Shutdown
 	}
 
+	shouldStop := func() bool {
+		return command != nil && command.Name == Stop
+	}
+
 	shouldQuit := func() bool {
 		return shouldShutdown() && (s.state == Stopped || s.state == Exited || s.state == Fatal)
 	}
 
-	for !shouldQuit() {
+	startAfter := func(delay time.Duration) {
+		delays++
+		schedule(time.Now().Add(delay))
+		after(delay, delayed, delays)
+	}
+
+	// restartable returns true if the restart policy restarts a process which
+	// exited with err.
+	restartable := func(err error) bool {
+		policy := cfg.restartPolicy
+		return !shouldShutdown() && !shouldStop() && (policy == RestartAlways || policy == RestartOnFailure && failed(err))
+	}
+
+	vetoed := func(err error) bool {
+		attempts++
+		return cfg.shouldRestart != nil && !cfg.shouldRestart(err, exitCode, attempts)
+	}
+
+	// startAgain starts the process again, counting the start as a restart if
+	// the process reaches Starting.
+	startAgain := func(commanded bool) {
+		restartPending, restartCommanded = true, commanded
+		start()
+		restartPending = false
+	}
+
+	restart := func() {
+		if cfg.restartBudget == nil || cfg.restartBudget.take() {
+			startAgain(false)
+		} else if cfg.restartBudget.fatal() {
+			retries = 0
+			attempts = 0
+			sendEvent(Fatal, ErrRestartBudget)
+		} else {
+			startAfter(cfg.restartBudget.wait())
+		}
+	}
+
+	stopped := func() {
+		sendEvent(Stopped, nil)
+		if command != nil && command.Name == Restart {
+			startAgain(true)
+		} else if restarting && !shouldShutdown() {
+			start()
+		}
+		restarting = false
+	}
+
+	// reschedule sets the timer for the next scheduled restart of a process
+	// which was just started. A restart which was due is satisfied by the start.
+	reschedule := func() {
+		restarts, err := parseSchedule(cfg.restartSchedule)
+		if cfg.restartSchedule == "" || err != nil {
+			return
+		}
+		if !scheduledAt.After(time.Now()) {
+			scheduledAt = restarts.next(time.Now())
+		}
+		if !scheduledAt.IsZero() {
+			scheduled.Reset(time.Until(scheduledAt))
+		}
+	}
+
+	// restartScheduled restarts a Running process if its scheduled restart is
+	// due. A restart which comes due while a command is pending waits for the
+	// command to complete, unless the command restarts the process itself.
+	restartScheduled := func() {
+		if s.state != Running || command != nil || shouldShutdown() || scheduledAt.IsZero() || scheduledAt.After(time.Now()) {
+			return
+		}
+		scheduledAt = time.Time{}
+		restarting = true
+		stop(errors.New("restarting on schedule"))
+	}
+
+	if adopted != nil {
+		start()
+	}
+
+	for !shouldQuit() && !abandoned {
+		restartScheduled()
 		select {
+		case <-resumed:
+			if suppressed > 0 && !s.eventsSuspended() {
+				events <- Event{Service: s, State: s.state, Labels: cfg.labels, Suppressed: suppressed}
+				suppressed = 0
+			}
 		case state := <-states:
+			if state.State != Running {
+				exitCode, exitSignal = exitStatus(state.Error)
+			}
+			if s.state == Starting && state.State != Running && cfg.metrics != nil {
+				// The attempt failed however the state changes after it.
+				cfg.metrics.AddStartFailure(s)
+			}
+			if s.state == Starting && state.State == Backoff && shouldStop() {
+				// The process is stopped either way, so it is not retried.
+				state.State = Exited
+			}
+			if s.state == Starting && state.State == Exited && restartable(state.Error) {
+				// A process which failed to start would fail again at once,
+				// so it is retried with backoff like a premature exit.
+				state.State = Backoff
+			}
 			switch state.State {
 			case Running:
-				retries = 0
-				if shouldShutdown() {
-					stop()
+				if shouldShutdown() || shouldStop() {
+					stop(nil)
 				} else {
 					sendEvent(Running, nil)
+					reschedule()
+					healthies++
+					if cfg.healthyAfter > 0 {
+						after(cfg.healthyAfter, healthy, healthies)
+					} else {
+						retries = 0
+						attempts = 0
+					}
 				}
 			case Exited:
-				retries = 0
 				if s.state == Stopping {
-					sendEvent(Stopped, nil)
+					retries = 0
+					attempts = 0
+					stopped()
 				} else {
 					sendEvent(Exited, state.Error)
-					if s.StopRestart {
-						start()
+					if restartable(state.Error) {
+						if vetoed(state.Error) {
+							retries = 0
+							attempts = 0
+							sendEvent(Fatal, ErrRestartVetoed)
+						} else {
+							restart()
+						}
 					}
 				}
 			case Backoff:
 				if s.state == Stopping {
 					retries = 0
-					sendEvent(Stopped, nil)
+					attempts = 0
+					stopped()
 				} else {
-					if retries < s.StartRetries {
+					if retries == 0 {
+						backoffSince = time.Now()
+					}
+					backoffExpired := cfg.maxBackoffTime > 0 && time.Since(backoffSince) >= cfg.maxBackoffTime || shouldShutdown()
+					if retries < cfg.startRetries && !backoffExpired && vetoed(state.Error) {
+						retries = 0
+						attempts = 0
+						sendEvent(Fatal, ErrRestartVetoed)
+					} else if retries < cfg.startRetries && !backoffExpired {
+						delay := cfg.backoff(retries)
 						retries++
+						// Schedule the start first so NextRestart is set
+						// by the time the Backoff event is received.
+						if delay > 0 {
+							startAfter(delay)
+						}
 						sendEvent(Backoff, state.Error)
-						start()
+						cfg.log(slog.LevelWarn, "backing off before restarting", "delay", delay, "retry", retries)
+						if delay <= 0 {
+							restart()
+						}
 					} else {
 						retries = 0
+						attempts = 0
 						sendEvent(Fatal, state.Error)
+						if cfg.fatalCooldown > 0 {
+							startAfter(cfg.fatalCooldown)
+						}
 					}
 				}
 			}
 		case newCommand := <-commands:
+			if !newCommand.Name.valid() {
+				newCommand.respond(Response{Service: s, Error: fmt.Errorf("%w: %s", ErrUnknownCommand, newCommand.Name)})
+				continue
+			}
+			if newCommand.Name == Query {
+				newCommand.respond(Response{Service: s, State: s.state})
+				continue
+			}
+
 			if command != nil {
 				if newCommand.Name == Shutdown {
 					// Fail previous command to force shutdown.
-					command.respond(s, errors.New("service is shutting down"))
+					command.respond(Response{Service: s, Error: errors.New("service is shutting down")})
 				} else {
 					// Don't allow execution of more than one command at a time.
-					newCommand.respond(s, errors.New("command %s is currently executing"))
+					newCommand.respond(Response{Service: s, Error: fmt.Errorf("%w: command %s is currently executing", ErrBusy, command.Name)})
 					continue
 				}
 			}
 
 			command = &newCommand
-			if s.CommandHook != nil {
-				if err := s.CommandHook(s, command.Name); err != nil {
+			s.setPending(command.Name)
+			s.config.Lock()
+			hook, handsOver := s.CommandHook, s.HandoverSignal != 0
+			s.config.Unlock()
+			if hook != nil {
+				if err := hook(s, command.Name); err != nil {
 					sendResponse(err)
 					continue
 				}
@@ -336,36 +1420,130 @@ func (s *Service) Run(commands <-chan Command, events chan<- Event) {
 			case Start:
 				start()
 			case Stop:
-				stop()
-			case Restart:
 				switch s.state {
-				case Running:
-					stop()
-				case Stopped:
-					start()
-				case Exited:
-					start()
-				case Fatal:
-					start()
+				case Starting:
+					// Stopped once the start succeeds or fails.
+				case Backoff:
+					delays++ // Cancel the delayed start.
+					schedule(time.Time{})
+					retries = 0
+					attempts = 0
+					sendEvent(Stopped, nil)
 				default:
+					stop(nil)
+				}
+			case Reload:
+				reload()
+			case Restart:
+				if !allowed(Restart, s.state) {
 					sendResponse(invalidStateError(Stopping))
+				} else if s.state == Running && handsOver {
+					handover()
+				} else if s.state == Running {
+					stop(nil)
+				} else {
+					startAgain(true)
 				}
 			case Shutdown:
 				switch s.state {
 				case Running:
-					stop()
+					stop(nil)
 				case Backoff:
-					s.state = Fatal
+					s.setState(Fatal)
+					s.updateMetrics(cfg.metrics, Fatal)
+					schedule(time.Time{})
+				}
+			}
+		case <-cancelled:
+			cancelled = nil
+			if command != nil {
+				command.respond(Response{Service: s, Error: errors.New("service is shutting down")})
+			}
+			command = &Command{Name: Shutdown}
+			s.setPending(command.Name)
+			switch s.state {
+			case Running:
+				stop(nil)
+			case Backoff:
+				s.setState(Fatal)
+				s.updateMetrics(cfg.metrics, Fatal)
+				schedule(time.Time{})
+			}
+		case failure := <-probeFailed:
+			if failure.ID == starts && s.state == Starting {
+				sendWarning(failure.Error)
+			}
+		case result := <-handedOver:
+			if result.ID == handovers && command != nil && command.Name == Restart && s.state == Running {
+				if result.Error == nil {
+					s.countRestart(cfg.metrics, true)
+					reschedule()
 				}
+				sendResponse(result.Error)
+			}
+		case id := <-delayed:
+			if id == delays && !shouldShutdown() {
+				schedule(time.Time{})
+				restart()
+			}
+		case id := <-healthy:
+			if id == healthies && s.state == Running {
+				retries = 0
+				attempts = 0
+			}
+		case <-scheduled.C:
+			restartScheduled()
+		case <-rolledBack:
+			if s.state == Running && command == nil {
+				restarting = true
+				stop(errors.New("restarting after rollback"))
+			}
+		case line := <-outputMatch:
+			if s.state == Running && command == nil && time.Since(lastOutputRestart) >= cfg.restartOnOutputDebounce {
+				lastOutputRestart = time.Now()
+				restarting = true
+				stop(fmt.Errorf("restarting on output: %s", line))
 			}
 		case pid := <-kill:
-			if pid == s.Pid() {
-				s.command.Process.Kill() //TODO: Check for error.
+			if pid == s.Pid() && s.IsAlive() {
+				signal := cfg.killSignal
+				var err error
+				if signal == 0 || signal == syscall.SIGKILL {
+					signal = syscall.SIGKILL
+					err = s.command.Kill()
+				} else {
+					err = s.command.Signal(signal)
+				}
+				if err != nil {
+					cfg.log(slog.LevelWarn, "failed to kill process", "pid", pid, "signal", signal, "error", err)
+				} else {
+					cfg.log(slog.LevelWarn, "killed process which did not stop", "pid", pid, "signal", signal)
+				}
+				if command != nil && (command.Name == Stop || command.Name == Restart || command.Name == Shutdown) {
+					forced = true
+				}
+				if cfg.onForceKill != nil {
+					go cfg.onForceKill(pid)
+				}
+				after(cfg.stopTimeout, stuck, pid)
+			}
+		case pid := <-slow:
+			if pid == s.Pid() && s.state == Stopping {
+				sendWarning(ErrSlowStop)
+			}
+		case pid := <-stuck:
+			if pid == s.Pid() && s.IsAlive() && uninterruptible(pid) {
+				// Not even the kill signal can stop the process until its
+				// I/O completes. Give up on it rather than block forever.
+				sendEvent(Fatal, ErrUninterruptible)
+				sendResponse(ErrUninterruptible)
+				abandoned = true
 			}
 		}
 	}
 
 	if command != nil {
-		command.respond(s, nil)
+		command.respond(Response{Service: s, Forced: forced, ExitCode: exitCode, Signal: exitSignal})
+		s.setPending("")
 	}
 }
@@ -1,9 +1,17 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -14,6 +22,7 @@ func TestService(t *testing.T) {
 		t.Errorf("NewService => error{%s}, wanted Service", err)
 		return
 	}
+	svc.BackoffInitial = 10 * time.Millisecond
 
 	pid := svc.Pid()
 	if svc.Pid() != 0 {
@@ -36,7 +45,7 @@ func TestService(t *testing.T) {
 		return true
 	}
 
-	verifyStates := func(states []string) {
+	verifyStates := func(states []State) {
 		for _, state := range states {
 			event := <-events
 			if event.Service != svc {
@@ -53,8 +62,8 @@ func TestService(t *testing.T) {
 		}
 	}
 
-	verifyCommand := func(command string, states []string, success bool) {
-		commands <- Command{command, responses}
+	verifyCommand := func(command CommandName, states []State, success bool) {
+		commands <- Command{Name: command, Response: responses}
 		verifyStates(states)
 
 		response := <-responses
@@ -75,53 +84,1393 @@ func TestService(t *testing.T) {
 
 	// Not Running on Run() and Shutdown works without a Start.
 	go svc.Run(commands, events)
-	verifyCommand(Stop, []string{}, false)
-	verifyCommand(Shutdown, []string{}, true)
+	verifyCommand(Stop, []State{}, false)
+	verifyCommand(Shutdown, []State{}, true)
 
 	// Start works properly and Shutdown works when Running.
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{Starting, Running}, true)
-	verifyCommand(Start, []string{}, false)
-	verifyCommand(Shutdown, []string{Stopping, Stopped}, true)
+	verifyCommand(Start, []State{Starting, Running}, true)
+	verifyCommand(Start, []State{}, false)
+	verifyCommand(Shutdown, []State{Stopping, Stopped}, true)
 
 	// Stop works properly and Shutdown works after Stopped.
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{Starting, Running}, true)
-	verifyCommand(Stop, []string{Stopping, Stopped}, true)
-	verifyCommand(Shutdown, []string{}, true)
+	verifyCommand(Start, []State{Starting, Running}, true)
+	verifyCommand(Stop, []State{Stopping, Stopped}, true)
+	verifyCommand(Shutdown, []State{}, true)
 
 	// Receives Exited and restarts.
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{Starting, Running}, true)
-	verifyStates([]string{Exited, Starting, Running})
-	verifyCommand(Shutdown, []string{Stopping, Stopped}, true)
+	verifyCommand(Start, []State{Starting, Running}, true)
+	verifyStates([]State{Exited, Starting, Running})
+	verifyCommand(Shutdown, []State{Stopping, Stopped}, true)
 
 	// Receives Exited and Shutdown works after Exited.
 	svc.StopRestart = false
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{Starting, Running}, true)
-	verifyStates([]string{Exited})
-	verifyCommand(Shutdown, []string{}, true)
+	verifyCommand(Start, []State{Starting, Running}, true)
+	verifyStates([]State{Exited})
+	verifyCommand(Shutdown, []State{}, true)
 
 	// Receives Backoff and Shutdown works after Backoff.
 	svc.StartTimeout = 3 * time.Second
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{Starting, Backoff, Starting, Backoff, Starting, Backoff, Starting, Fatal}, false)
-	verifyCommand(Shutdown, []string{}, true)
+	verifyCommand(Start, []State{Starting, Backoff, Starting, Backoff, Starting, Backoff, Starting, Fatal}, false)
+	verifyCommand(Shutdown, []State{}, true)
 	svc.StartTimeout = 1 * time.Second
 
 	// Receives nothing on command error.
 	svc.state = Stopped
-	svc.CommandHook = func(svc *Service, command string) (err error) {
+	svc.CommandHook = func(svc *Service, command CommandName) (err error) {
 		if command != Shutdown {
 			err = errors.New("oops")
 		}
 		return
 	}
 	go svc.Run(commands, events)
-	verifyCommand(Start, []string{}, false)
+	verifyCommand(Start, []State{}, false)
 	if svc.State() != Stopped {
 		t.Errorf("svc.State() => %s, wanted %s", svc.State(), Stopped)
 	}
-	verifyCommand(Shutdown, []string{}, true)
+	verifyCommand(Shutdown, []State{}, true)
+}
+
+// harness drives a Service's Run loop from a test.
+type harness struct {
+	t         *testing.T
+	svc       *Service
+	commands  chan Command
+	responses chan Response
+	events    chan Event
+}
+
+// run starts svc.Run in a goroutine and returns a harness to control it.
+func run(t *testing.T, svc *Service) *harness {
+	h := &harness{t, svc, make(chan Command), make(chan Response, 1), make(chan Event)}
+	go svc.Run(h.commands, h.events)
+	return h
+}
+
+// send issues a command to the service without waiting for the response.
+func (h *harness) send(name CommandName) {
+	select {
+	case h.commands <- Command{Name: name, Response: h.responses}:
+	case <-time.After(10 * time.Second):
+		h.t.Fatalf("timed out sending command %s", name)
+	}
+}
+
+// expect reads events from the service and verifies they match states.
+func (h *harness) expect(states ...State) []Event {
+	events := make([]Event, 0, len(states))
+	for _, state := range states {
+		select {
+		case event := <-h.events:
+			if event.State != state {
+				h.t.Fatalf("event.State => %s, wanted %s", event.State, state)
+			}
+			events = append(events, event)
+		case <-time.After(10 * time.Second):
+			h.t.Fatalf("timed out waiting for event %s", state)
+		}
+	}
+	return events
+}
+
+// response waits for the response to a previously sent command.
+func (h *harness) response() Response {
+	select {
+	case response := <-h.responses:
+		return response
+	case <-time.After(10 * time.Second):
+		h.t.Fatalf("timed out waiting for response")
+	}
+	return Response{}
+}
+
+// shutdown stops the service and waits for Run to return, discarding events.
+func (h *harness) shutdown() {
+	commands := h.commands
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case commands <- Command{Name: Shutdown, Response: h.responses}:
+			commands = nil
+		case <-h.events:
+		case response := <-h.responses:
+			if response.Name == Shutdown {
+				return
+			}
+		case <-timeout:
+			h.t.Fatalf("timed out shutting down service")
+		}
+	}
+}
+
+func TestNewServiceEmptyArgs(t *testing.T) {
+	for _, args := range [][]string{nil, {}} {
+		if svc, err := NewService(args); err == nil || svc != nil {
+			t.Errorf("NewService(%q) => %v, %v, wanted nil and an error", args, svc, err)
+		}
+	}
+}
+
+func TestNewServiceNoWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Getwd(); err == nil {
+		t.Skip("os.Getwd succeeds in a removed directory on this platform")
+	}
+
+	svc, err := NewService([]string{"true"})
+	if err != nil {
+		t.Fatalf("NewService => %v, wanted no error", err)
+	}
+	if svc.Directory != "" {
+		t.Errorf("svc.Directory => %q, wanted it empty", svc.Directory)
+	}
+}
+
+func TestDrainProbe(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.DrainInterval = 10 * time.Millisecond
+
+	delay := 500 * time.Millisecond
+	var drainStart time.Time
+	svc.DrainProbe = func(*Service) error {
+		if drainStart.IsZero() {
+			drainStart = time.Now()
+		}
+		if time.Since(drainStart) < delay {
+			return errors.New("connections active")
+		}
+		return nil
+	}
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	h.send(Stop)
+	h.expect(Stopping)
+	stopping := time.Now()
+	h.expect(Stopped)
+	if elapsed := time.Since(stopping); elapsed < delay {
+		t.Errorf("stop took %s, wanted at least %s", elapsed, delay)
+	}
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Success() => false, wanted true, error{%s}", response.Error)
+	}
+	h.shutdown()
+}
+
+func TestReadinessProbe(t *testing.T) {
+	notReady := errors.New("not listening")
+	tests := []struct {
+		name   string
+		ready  time.Duration
+		states []State
+	}{
+		{"immediate", 0, []State{Starting, Running}},
+		{"late", 200 * time.Millisecond, []State{Starting, Running}},
+		{"never", time.Hour, []State{Starting, Fatal}},
+	}
+	for _, test := range tests {
+		svc, _ := NewService([]string{"server"})
+		svc.StartTimeout = 500 * time.Millisecond
+		svc.StartRetries = 0
+		svc.ReadinessInterval = 10 * time.Millisecond
+		svc.CommandFactory = fakeFactory(newFakeRunner(100))
+
+		var started time.Time
+		svc.ReadinessProbe = func(context.Context, *Service) error {
+			if started.IsZero() {
+				started = time.Now()
+			}
+			if time.Since(started) < test.ready {
+				return notReady
+			}
+			return nil
+		}
+
+		h := run(t, svc)
+		start := time.Now()
+		h.send(Start)
+		events := h.expect(test.states...)
+		elapsed := time.Since(start)
+		h.response()
+		h.shutdown()
+
+		switch test.name {
+		case "immediate":
+			if elapsed >= 100*time.Millisecond {
+				t.Errorf("%s: Running after %s, wanted it before StartTimeout", test.name, elapsed)
+			}
+		case "late":
+			if elapsed < test.ready || elapsed >= svc.StartTimeout {
+				t.Errorf("%s: Running after %s, wanted it once the probe succeeds", test.name, elapsed)
+			}
+		case "never":
+			if !strings.Contains(events[1].Error.Error(), notReady.Error()) {
+				t.Errorf("%s: event.Error => %v, wanted the probe error", test.name, events[1].Error)
+			}
+		}
+	}
+}
+
+func TestReadinessProbeContext(t *testing.T) {
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 500 * time.Millisecond
+	svc.StartRetries = 0
+	svc.ReadinessInterval = 0
+	svc.CommandFactory = fakeFactory(newFakeRunner(100))
+
+	var calls int
+	var deadline time.Time
+	var third time.Time
+	svc.ReadinessProbe = func(ctx context.Context, _ *Service) error {
+		if calls++; calls < 3 {
+			return errors.New("not listening")
+		}
+		// A probe which blocks until its context expires must not hold the
+		// start past StartTimeout.
+		third = time.Now()
+		deadline, _ = ctx.Deadline()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	start := time.Now()
+	h.send(Start)
+	h.expect(Starting, Fatal)
+	h.response()
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("Fatal after %s, wanted the blocked probe to give up after StartTimeout", elapsed)
+	}
+	if deadline.IsZero() || deadline.After(start.Add(svc.StartTimeout+time.Second)) {
+		t.Errorf("probe deadline => %s after the start, wanted about StartTimeout", deadline.Sub(start))
+	}
+	// A zero interval polls at DefaultReadinessInterval rather than spinning.
+	if polled := third.Sub(start); polled < DefaultReadinessInterval {
+		t.Errorf("third probe after %s, wanted the default interval between probes", polled)
+	}
+}
+
+func TestReadinessEvents(t *testing.T) {
+	notReady := errors.New("connection refused")
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StartRetries = 1
+	svc.BackoffInitial = time.Hour
+	svc.ReadinessInterval = 30 * time.Millisecond
+	svc.ReadinessEvents = true
+	svc.CommandFactory = fakeFactory(newFakeRunner(100))
+	svc.ReadinessProbe = func(context.Context, *Service) error { return notReady }
+	handler := &captureHandler{}
+	svc.Logger = slog.New(handler)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting)
+	failures := 0
+	for event := range h.events {
+		if event.State == Backoff {
+			break
+		}
+		if event.State != Starting {
+			t.Fatalf("event.State => %s, wanted %s or %s", event.State, Starting, Backoff)
+		}
+		var probeErr *ProbeError
+		if !errors.As(event.Error, &probeErr) || probeErr.Probe != "readiness" || probeErr.Err != notReady {
+			t.Errorf("event.Error => %v, wanted a readiness *ProbeError", event.Error)
+		}
+		if message := event.Error.Error(); message != "readiness failing: connection refused" {
+			t.Errorf("event.Error.Error() => %q, wanted %q", message, "readiness failing: connection refused")
+		}
+		failures++
+	}
+	if failures < 2 {
+		t.Errorf("got %d probe failure events before Backoff, wanted at least 2", failures)
+	}
+	// The failures are not transitions.
+	for _, transition := range handler.find("state transition") {
+		if transition["from"] == "starting" && transition["to"] == "starting" {
+			t.Errorf("logged a transition from starting to starting for a probe failure")
+			break
+		}
+	}
+}
+
+func TestExitErrorUnwrap(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", "exit 3"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StartRetries = 0
+
+	h := run(t, svc)
+	h.send(Start)
+	events := h.expect(Starting, Fatal)
+	h.response()
+	h.shutdown()
+
+	var exitErr *exec.ExitError
+	if !errors.As(events[1].Error, &exitErr) {
+		t.Fatalf("errors.As(event.Error) => false, wanted *exec.ExitError")
+	}
+	if code := exitErr.ExitCode(); code != 3 {
+		t.Errorf("exitErr.ExitCode() => %d, wanted 3", code)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+		signal syscall.Signal
+	}{
+		{"exit 3", 3, 0},
+		{"kill -TERM $$", -1, syscall.SIGTERM},
+	}
+	for _, test := range tests {
+		svc, _ := NewService([]string{"sh", "-c", test.script})
+		svc.StartTimeout = 100 * time.Millisecond
+		svc.StartRetries = 0
+
+		h := run(t, svc)
+		h.send(Start)
+		events := h.expect(Starting, Fatal)
+		response := h.response()
+		h.shutdown()
+
+		if code, signal := events[1].ExitCode, events[1].Signal; code != test.code || signal != test.signal {
+			t.Errorf("%q: event exit => %d, %v, wanted %d, %v", test.script, code, signal, test.code, test.signal)
+		}
+		if code, signal := response.ExitCode, response.Signal; code != test.code || signal != test.signal {
+			t.Errorf("%q: response exit => %d, %v, wanted %d, %v", test.script, code, signal, test.code, test.signal)
+		}
+	}
+}
+
+func TestExitCodeStartFailure(t *testing.T) {
+	svc, _ := NewService([]string{"/nonexistent/server"})
+	svc.StopRestart = false
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	events := h.expect(Starting, Exited)
+	response := h.response()
+	if code := events[1].ExitCode; code != -1 {
+		t.Errorf("event.ExitCode => %d, wanted -1", code)
+	}
+	if code := response.ExitCode; code != -1 {
+		t.Errorf("response.ExitCode => %d, wanted -1", code)
+	}
+}
+
+func TestStartFailureBackoff(t *testing.T) {
+	svc, _ := NewService([]string{"/nonexistent/server"})
+	svc.StartRetries = 2
+	svc.BackoffInitial = 10 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	// The start fails the same way each time, so it is retried with backoff
+	// until the retries run out rather than restarted at once.
+	h.expect(Starting, Backoff, Starting, Backoff, Starting, Fatal)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Error => nil, wanted the start to fail")
+	}
+	select {
+	case event := <-h.events:
+		t.Errorf("got %s event after Fatal, wanted none", event.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStopDuringBackoff(t *testing.T) {
+	failure := errors.New("exit status 1")
+	first, crash := newFakeRunner(100), newFakeRunner(101)
+	crash.Exit(failure)
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = time.Minute
+	svc.CommandFactory = fakeFactory(first, crash)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	first.Exit(failure)
+	h.expect(Exited, Starting, Backoff)
+
+	// The delayed start is cancelled.
+	h.send(Stop)
+	h.expect(Stopped)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Error => %v, wanted nil", response.Error)
+	}
+	if next := svc.NextRestart(); !next.IsZero() {
+		t.Errorf("svc.NextRestart() => %s after Stop, wanted zero", next)
+	}
+}
+
+func TestStopDuringStart(t *testing.T) {
+	first := newFakeRunner(100)
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 300 * time.Millisecond
+	svc.CommandFactory = fakeFactory(first, newFakeRunner(101))
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	first.Exit(errors.New("exit status 1"))
+	h.expect(Exited, Starting)
+
+	// The process is stopped once it is ready.
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Error => %v, wanted nil", response.Error)
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	tests := []struct {
+		state    State
+		commands []CommandName
+	}{
+		{Starting, []CommandName{Stop, Shutdown, Query}},
+		{Running, []CommandName{Stop, Restart, Shutdown, Query, Reload}},
+		{Stopping, []CommandName{Shutdown, Query}},
+		{Stopped, []CommandName{Start, Restart, Shutdown, Query}},
+		{Exited, []CommandName{Start, Restart, Shutdown, Query}},
+		{Backoff, []CommandName{Start, Stop, Shutdown, Query}},
+		{Fatal, []CommandName{Start, Restart, Shutdown, Query}},
+	}
+
+	svc, _ := NewService([]string{"sleep", "1"})
+	for _, test := range tests {
+		svc.state = test.state
+		commands := svc.AllowedCommands()
+		if fmt.Sprint(commands) != fmt.Sprint(test.commands) {
+			t.Errorf("svc.AllowedCommands() in %s => %v, wanted %v", test.state, commands, test.commands)
+		}
+	}
+}
+
+func TestRestartRunning(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := svc.Pid()
+
+	h.send(Restart)
+	h.expect(Stopping, Stopped, Starting, Running)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Success() => false, wanted true, error{%s}", response.Error)
+	}
+	if svc.Pid() == pid {
+		t.Errorf("svc.Pid() => %d after restart, wanted a new process", pid)
+	}
+}
+
+func TestStopForced(t *testing.T) {
+	stop := func(args []string) Response {
+		svc, _ := NewService(args)
+		svc.StartTimeout = 100 * time.Millisecond
+		svc.StopTimeout = 200 * time.Millisecond
+
+		h := run(t, svc)
+		defer h.shutdown()
+		h.send(Start)
+		h.expect(Starting, Running)
+		h.response()
+		h.send(Stop)
+		h.expect(Stopping, Stopped)
+		return h.response()
+	}
+
+	if response := stop([]string{"sleep", "10"}); !response.Success() || response.Forced {
+		t.Errorf("graceful stop => Success() %t, Forced %t, wanted true, false", response.Success(), response.Forced)
+	}
+	if response := stop([]string{"sh", "-c", `trap "" INT; while :; do sleep 0.1; done`}); !response.Success() || !response.Forced {
+		t.Errorf("forced stop => Success() %t, Forced %t, wanted true, true", response.Success(), response.Forced)
+	}
+}
+
+func TestStopSignals(t *testing.T) {
+	script := `trap 'if [ -n "$seen" ]; then exit 0; fi; seen=1' TERM; while :; do sleep 0.05; done`
+	svc, _ := NewService([]string{"sh", "-c", script})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopSignals = []StopStep{
+		{syscall.SIGTERM, 200 * time.Millisecond},
+		{syscall.SIGTERM, 5 * time.Second},
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	start := time.Now()
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	response := h.response()
+	elapsed := time.Since(start)
+	if !response.Success() || response.Forced {
+		t.Errorf("stop => Success() %t, Forced %t, wanted true, false", response.Success(), response.Forced)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("stopped after %s, wanted it to exit on the second signal", elapsed)
+	}
+}
+
+func TestStopPlan(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	plan := svc.StopPlan()
+	want := []StopStep{{DefaultStopSignal, DefaultStopTimeout}, {DefaultKillSignal, 0}}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("svc.StopPlan() => %v, wanted %v", plan, want)
+	}
+
+	svc.StopSignals = []StopStep{
+		{syscall.SIGTERM, time.Second},
+		{syscall.SIGTERM, 2 * time.Second},
+		{syscall.SIGINT, 3 * time.Second},
+	}
+	svc.KillSignal = syscall.SIGQUIT
+	plan = svc.StopPlan()
+	want = append(append([]StopStep(nil), svc.StopSignals...), StopStep{syscall.SIGQUIT, 0})
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("svc.StopPlan() => %v, wanted %v", plan, want)
+	}
+	if svc.State() != Stopped {
+		t.Errorf("svc.State() => %s after StopPlan, wanted %s", svc.State(), Stopped)
+	}
+}
+
+func TestKillSignal(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "term")
+	script := fmt.Sprintf(`trap "" INT; trap "touch %s; exit 1" TERM; while :; do sleep 0.05; done`, marker)
+	svc, _ := NewService([]string{"sh", "-c", script})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopTimeout = 200 * time.Millisecond
+	svc.KillSignal = syscall.SIGTERM
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	if response := h.response(); !response.Forced {
+		t.Errorf("response.Forced => false, wanted true")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("process did not receive SIGTERM: %s", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "signals")
+	script := fmt.Sprintf(`trap "echo hup >> %[1]s" HUP; trap "echo term >> %[1]s; exit 0" TERM; while :; do sleep 0.05; done`, log)
+	svc, _ := NewService([]string{"sh", "-c", script})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopSignal = syscall.SIGTERM
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Reload)
+	if response := h.response(); !response.Success() {
+		t.Fatalf("reload failed: %s", response.Error)
+	}
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+
+	signals, _ := os.ReadFile(log)
+	if string(signals) != "hup\nterm\n" {
+		t.Errorf("process received %q, wanted %q", signals, "hup\nterm\n")
+	}
+}
+
+func TestReloadSignalConflict(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.ReloadSignal = svc.StopSignal
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Reload)
+	if response := h.response(); response.Success() {
+		t.Errorf("reload with the stop signal succeeded, wanted an error")
+	}
+	if state := svc.State(); state != Running {
+		t.Errorf("svc.State() => %s, wanted %s", state, Running)
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	h.send(Reload)
+	if response := h.response(); response.Success() {
+		t.Errorf("reload while Stopped succeeded, wanted an error")
+	}
+}
+
+func TestCleanupCommand(t *testing.T) {
+	path := t.TempDir() + "/cleanup"
+	cleanups := func(want int) int {
+		// Cleanup runs in the background after the event is sent.
+		deadline := time.Now().Add(time.Second)
+		for {
+			data, _ := os.ReadFile(path)
+			if len(data) >= want || time.Now().After(deadline) {
+				return len(data)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	svc, _ := NewService([]string{"sleep", "0.3"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopRestart = false
+	svc.CleanupCommand = []string{"sh", "-c", "echo >> " + path}
+	svc.CleanupTimeout = 0
+
+	h := run(t, svc)
+	defer h.shutdown()
+
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	if n := cleanups(1); n != 1 {
+		t.Errorf("cleanup ran %d times after Stopped, wanted 1", n)
+	}
+
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.expect(Exited)
+	if n := cleanups(2); n != 2 {
+		t.Errorf("cleanup ran %d times after Exited, wanted 2", n)
+	}
+
+	h.send(Restart)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Restart)
+	h.expect(Stopping, Stopped, Starting, Running)
+	h.response()
+	time.Sleep(100 * time.Millisecond)
+	if n := cleanups(3); n != 2 {
+		t.Errorf("cleanup ran %d times after a Restart, wanted it not to run", n-2)
+	}
+}
+
+func TestCleanupCommandBlocking(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.CleanupCommand = []string{"sleep", "10"}
+	svc.CleanupTimeout = 5 * time.Second
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+
+	start := time.Now()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("start took %s while cleanup ran, wanted it not to wait", elapsed)
+	}
+}
+
+func TestStopSignalExitIsClean(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopSignal = syscall.SIGTERM
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	h.send(Stop)
+	events := h.expect(Stopping, Stopped)
+	if events[1].Error != nil {
+		t.Errorf("event.Error => %s, wanted nil", events[1].Error)
+	}
+	if response := h.response(); !response.Success() || response.Forced {
+		t.Errorf("response => Success() %t, Forced %t, wanted true, false", response.Success(), response.Forced)
+	}
+
+	select {
+	case event := <-h.events:
+		t.Errorf("event.State => %s after Stopped, wanted no restart", event.State)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestFatalCooldown(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", "exit 1"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StartRetries = 1
+	svc.BackoffInitial = 10 * time.Millisecond
+	svc.FatalCooldown = 300 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Backoff, Starting, Fatal)
+	if response := h.response(); response.Success() {
+		t.Errorf("response.Success() => true, wanted false")
+	}
+
+	fatal := time.Now()
+	h.expect(Starting)
+	if elapsed := time.Since(fatal); elapsed < svc.FatalCooldown {
+		t.Errorf("restarted %s after Fatal, wanted at least %s", elapsed, svc.FatalCooldown)
+	}
+	h.expect(Backoff, Starting, Fatal)
+}
+
+func TestPendingCommand(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 300 * time.Millisecond
+
+	if name, _ := svc.PendingCommand(); name != "" {
+		t.Errorf("svc.PendingCommand() => %s, wanted none", name)
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	sent := time.Now()
+	h.send(Start)
+	h.expect(Starting)
+	if name, since := svc.PendingCommand(); name != Start || since.Before(sent) || since.After(time.Now()) {
+		t.Errorf("svc.PendingCommand() => %s, %s, wanted %s since %s", name, since, Start, sent)
+	}
+
+	h.expect(Running)
+	h.response()
+	if name, _ := svc.PendingCommand(); name != "" {
+		t.Errorf("svc.PendingCommand() => %s after response, wanted none", name)
+	}
+}
+
+func TestMaxBackoffTime(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", "exit 1"})
+	svc.StartTimeout = 50 * time.Millisecond
+	svc.StartRetries = 1000
+	svc.BackoffInitial = 10 * time.Millisecond
+	svc.BackoffMax = 10 * time.Millisecond
+	svc.MaxBackoffTime = 400 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	started := time.Now()
+	h.send(Start)
+	h.expect(Starting, Backoff)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-h.events:
+			if event.State != Fatal {
+				continue
+			}
+			// Only the lower bound is exact. The upper one allows for a slow
+			// machine while still catching a retry budget which never runs out.
+			if elapsed := time.Since(started); elapsed < svc.MaxBackoffTime || elapsed > 10*svc.MaxBackoffTime {
+				t.Errorf("Fatal after %s of backoff, wanted about %s", elapsed, svc.MaxBackoffTime)
+			}
+			if response := h.response(); response.Success() {
+				t.Errorf("response.Success() => true, wanted false")
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for Fatal")
+		}
+	}
+}
+
+func TestOnForceKill(t *testing.T) {
+	killed := make(chan int, 1)
+	svc, _ := NewService([]string{"sh", "-c", `trap "" INT; while :; do sleep 0.1; done`})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopTimeout = 200 * time.Millisecond
+	svc.OnForceKill = func(pid int) {
+		killed <- pid
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := svc.Pid()
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	select {
+	case killedPid := <-killed:
+		if killedPid != pid {
+			t.Errorf("OnForceKill(%d), wanted pid %d", killedPid, pid)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("OnForceKill was not called")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Labels = map[string]string{"env": "prod", "team": "infra"}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	for _, event := range h.expect(Starting, Running) {
+		if event.Labels["env"] != "prod" || event.Labels["team"] != "infra" {
+			t.Errorf("event.Labels => %v, wanted %v", event.Labels, svc.Labels)
+		}
+	}
+	h.response()
+}
+
+func TestDone(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	done := svc.Done()
+
+	h := run(t, svc)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	h.send(Shutdown)
+	for _, state := range []State{Stopping, Stopped} {
+		select {
+		case <-done:
+			t.Fatalf("svc.Done() closed before the %s event", state)
+		default:
+		}
+		h.expect(state)
+	}
+	h.response()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("svc.Done() not closed after Run returned")
+	}
+	if svc.Done() != done {
+		t.Errorf("svc.Done() changed after Run returned")
+	}
+
+	// A new run gets a new channel.
+	h = run(t, svc)
+	h.shutdown()
+	if svc.Done() == done {
+		t.Errorf("svc.Done() => previous channel, wanted a new one after Run restarted")
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send("strat")
+	response := h.response()
+	if !errors.Is(response.Error, ErrUnknownCommand) {
+		t.Errorf("response.Error => %v, wanted ErrUnknownCommand", response.Error)
+	}
+	if response.Name != "strat" {
+		t.Errorf("response.Name => %s, wanted strat", response.Name)
+	}
+}
+
+func TestUnknownCommandWhilePending(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 300 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting)
+
+	// The unknown command is rejected as unknown rather than busy, and
+	// neither the state nor the pending Start is affected.
+	h.send("bogus")
+	if response := h.response(); response.Name != "bogus" || !errors.Is(response.Error, ErrUnknownCommand) {
+		t.Errorf("response => %s error{%v}, wanted bogus with ErrUnknownCommand", response.Name, response.Error)
+	}
+	if state := svc.State(); state != Starting {
+		t.Errorf("svc.State() => %s, wanted %s", state, Starting)
+	}
+
+	h.expect(Running)
+	if response := h.response(); response.Name != Start || !response.Success() {
+		t.Errorf("response => %s error{%v}, wanted successful %s", response.Name, response.Error, Start)
+	}
+}
+
+func TestCommandID(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 300 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.commands <- Command{Name: Start, Response: h.responses, ID: "first"}
+	h.expect(Starting)
+	h.commands <- Command{Name: Query, Response: h.responses, ID: "second"}
+
+	// The Query is answered before the Start it overtook.
+	if response := h.response(); response.Name != Query || response.ID != "second" {
+		t.Errorf("response => %s ID %q, wanted %s ID %q", response.Name, response.ID, Query, "second")
+	}
+	h.expect(Running)
+	if response := h.response(); response.Name != Start || response.ID != "first" {
+		t.Errorf("response => %s ID %q, wanted %s ID %q", response.Name, response.ID, Start, "first")
+	}
+}
+
+func TestSuspendEvents(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	svc.SuspendEvents()
+	h.send(Restart)
+	if response := h.response(); !response.Success() {
+		t.Errorf("response.Error => %v, wanted nil", response.Error)
+	}
+	h.send(Query)
+	if response := h.response(); response.State != Running {
+		t.Errorf("response.State => %s, wanted %s", response.State, Running)
+	}
+	select {
+	case event := <-h.events:
+		t.Errorf("got %s event while suspended, wanted none", event.State)
+	default:
+	}
+
+	svc.ResumeEvents()
+	summary := h.expect(Running)[0]
+	if summary.Suppressed != 4 {
+		t.Errorf("event.Suppressed => %d, wanted 4", summary.Suppressed)
+	}
+
+	h.send(Stop)
+	if event := h.expect(Stopping, Stopped)[0]; event.Suppressed != 0 {
+		t.Errorf("event.Suppressed after resuming => %d, wanted 0", event.Suppressed)
+	}
+	h.response()
+}
+
+func TestStateRace(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				svc.State()
+				svc.Pid()
+				svc.IsAlive()
+				svc.AllowedCommands()
+			}
+		}
+	}()
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	for i := 0; i < 5; i++ {
+		h.send(Restart)
+		h.expect(Stopping, Stopped, Starting, Running)
+		h.response()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestUptime(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 10 * time.Millisecond
+
+	if uptime := svc.Uptime(); uptime != 0 {
+		t.Errorf("svc.Uptime() before Start => %s, wanted 0", uptime)
+	}
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	running := h.expect(Starting, Running)[1]
+	h.response()
+	if running.StartedAt.IsZero() || !running.StartedAt.Equal(svc.StartedAt()) {
+		t.Errorf("event.StartedAt => %s, wanted svc.StartedAt() %s", running.StartedAt, svc.StartedAt())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if uptime := svc.Uptime(); uptime < 200*time.Millisecond || uptime > time.Since(running.StartedAt) {
+		t.Errorf("svc.Uptime() => %s, wanted the time since %s", uptime, running.StartedAt)
+	}
+
+	h.send(Restart)
+	restarted := h.expect(Stopping, Stopped, Starting, Running)[3]
+	h.response()
+	if !restarted.StartedAt.After(running.StartedAt) {
+		t.Errorf("event.StartedAt after Restart => %s, wanted after %s", restarted.StartedAt, running.StartedAt)
+	}
+	if uptime := svc.Uptime(); !svc.StartedAt().Equal(restarted.StartedAt) || uptime > time.Since(restarted.StartedAt) {
+		t.Errorf("svc.Uptime() after Restart => %s, wanted it reset", uptime)
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	if uptime, startedAt := svc.Uptime(), svc.StartedAt(); uptime != 0 || !startedAt.IsZero() {
+		t.Errorf("svc.Uptime(), svc.StartedAt() after Stop => %s, %s, wanted zero", uptime, startedAt)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 300 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Query)
+	if response := h.response(); response.Name != Query || !response.Success() || response.State != Stopped {
+		t.Errorf("response => %s %s error{%v}, wanted successful %s %s", response.Name, response.State, response.Error, Query, Stopped)
+	}
+
+	// Query is answered while Start is pending without affecting it.
+	h.send(Start)
+	last := h.expect(Starting)[0]
+	h.send(Query)
+	if response := h.response(); response.Name != Query || response.State != last.State {
+		t.Errorf("response => %s %s, wanted %s %s", response.Name, response.State, Query, last.State)
+	}
+
+	last = h.expect(Running)[0]
+	if response := h.response(); response.Name != Start || !response.Success() {
+		t.Errorf("response => %s error{%v}, wanted successful %s", response.Name, response.Error, Start)
+	}
+	h.send(Query)
+	if response := h.response(); response.State != last.State {
+		t.Errorf("response.State => %s, wanted %s", response.State, last.State)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 300 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting)
+	h.send(Stop)
+	response := h.response()
+	if response.Name != Stop || !errors.Is(response.Error, ErrBusy) {
+		t.Errorf("response => %s error{%v}, wanted %s with ErrBusy", response.Name, response.Error, Stop)
+	}
+	if want := "service is busy: command start is currently executing"; response.Error == nil || response.Error.Error() != want {
+		t.Errorf("response.Error => %v, wanted %q", response.Error, want)
+	}
+
+	h.expect(Running)
+	if response := h.response(); response.Name != Start || !response.Success() {
+		t.Errorf("response => %s error{%v}, wanted successful %s", response.Name, response.Error, Start)
+	}
+}
+
+func TestStopWarnAfter(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", `trap "" INT; while :; do sleep 0.05; done`})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopTimeout = 500 * time.Millisecond
+	svc.StopWarnAfter = 100 * time.Millisecond
+	handler := &captureHandler{}
+	svc.Logger = slog.New(handler)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	h.send(Stop)
+	start := time.Now()
+	h.expect(Stopping)
+	warning := h.expect(Stopping)[0]
+	warned := time.Since(start)
+	if !errors.Is(warning.Error, ErrSlowStop) {
+		t.Errorf("event.Error => %v, wanted ErrSlowStop", warning.Error)
+	}
+	if warned < svc.StopWarnAfter || warned >= svc.StopTimeout {
+		t.Errorf("warned after %s, wanted between %s and %s", warned, svc.StopWarnAfter, svc.StopTimeout)
+	}
+	h.expect(Stopped)
+	if response := h.response(); !response.Forced {
+		t.Errorf("response.Forced => false, wanted the process killed after the warning")
+	}
+	// The warning is not a transition.
+	for _, transition := range handler.find("state transition") {
+		if transition["from"] == "stopping" && transition["to"] == "stopping" {
+			t.Errorf("logged a transition from stopping to stopping for the slow stop warning")
+			break
+		}
+	}
+}
+
+func TestForcedNotLeaked(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", `trap "" INT; while :; do sleep 0.05; done`})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopTimeout = 100 * time.Millisecond
+	svc.RestartSchedule = "@every 300ms"
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	// The scheduled restart kills the process without a command to answer,
+	// so the kill must not be reported to the next unrelated command.
+	h.expect(Stopping, Stopped, Starting, Running)
+	h.send(Start)
+	if response := h.response(); response.Success() || response.Forced {
+		t.Errorf("response => error{%v} forced{%t}, wanted an error without Forced", response.Error, response.Forced)
+	}
+}
+
+func TestConfigureStopSignal(t *testing.T) {
+	path := t.TempDir() + "/signal"
+	svc, _ := NewService([]string{"sh", "-c", `trap "" INT; trap "echo term > ` + path + `; exit 0" TERM; while :; do sleep 0.1; done`})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopTimeout = 2 * time.Second
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	svc.Configure(func(svc *Service) {
+		svc.StopSignal = syscall.SIGTERM
+	})
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	if response := h.response(); response.Forced {
+		t.Errorf("response.Forced => true, wanted the process to stop on SIGTERM")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "term\n" {
+		t.Errorf("process received %q, wanted term", data)
+	}
+}
+
+func TestConfigureDuringStart(t *testing.T) {
+	runner := newFakeRunner(100)
+	runner.delay = 50 * time.Millisecond
+	svc, _ := NewService([]string{"server"})
+	svc.StartTimeout = 200 * time.Millisecond
+	svc.ReadinessInterval = 10 * time.Millisecond
+	svc.ReadinessProbe = func(context.Context, *Service) error { return nil }
+	svc.CommandFactory = fakeFactory(runner)
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting)
+
+	// Change the settings the in-flight start uses while it runs. Run with
+	// -race to check that they are not read without the config lock.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			svc.Configure(func(svc *Service) {
+				svc.StartTimeout = time.Hour
+				svc.StartTimeoutAtLaunch = !svc.StartTimeoutAtLaunch
+				svc.ReadinessProbe = func(context.Context, *Service) error { return errors.New("not ready") }
+				svc.ReadinessInterval = time.Millisecond
+				svc.HealthyAfter = time.Hour
+				svc.BinaryStable = 0
+				svc.CommandFactory = nil
+				svc.RestartPolicy = RestartNever
+				svc.Logger = nil
+				svc.Metrics = nil
+			})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// The start keeps the StartTimeout and probe it began with.
+	select {
+	case event := <-h.events:
+		if event.State != Running {
+			t.Errorf("event.State => %s, wanted %s", event.State, Running)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no Running event, wanted the start to use its original settings")
+	}
+	close(stop)
+	<-done
+	h.response()
+}
+
+func TestIsAlive(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	if svc.IsAlive() {
+		t.Errorf("svc.IsAlive() => true before start, wanted false")
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := svc.Pid()
+	if !svc.IsAlive() {
+		t.Errorf("svc.IsAlive() => false while Running, wanted true")
+	}
+	if _, err := os.Stat("/proc/self"); err == nil {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			t.Errorf("svc.IsAlive() => true, but /proc/%d does not exist", pid)
+		}
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	if svc.IsAlive() {
+		t.Errorf("svc.IsAlive() => true after Stopped, wanted false")
+	}
+}
+
+func TestIntentionalStop(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	h.commands <- Command{Name: Stop, Response: h.responses, Intentional: true}
+	events := h.expect(Stopping, Stopped)
+	h.response()
+	if events[0].Intentional {
+		t.Errorf("Stopping event.Intentional => true, wanted false")
+	}
+	if !events[1].Intentional {
+		t.Errorf("Stopped event.Intentional => false, wanted true")
+	}
+
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	h.send(Restart)
+	events = h.expect(Stopping, Stopped, Starting, Running)
+	h.response()
+	if events[1].Intentional {
+		t.Errorf("Stopped event.Intentional => true on a Restart, wanted false")
+	}
+}
+
+func TestOnCommand(t *testing.T) {
+	type audit struct {
+		cmd      Command
+		response Response
+	}
+	audits := make(chan audit, 2)
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.OnCommand = func(cmd Command, response Response) {
+		audits <- audit{cmd, response}
+	}
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.commands <- Command{Name: Start, Response: h.responses, Actor: "alice"}
+	events := h.expect(Starting, Running)
+	response := h.response()
+	if response.Actor != "alice" {
+		t.Errorf("response.Actor => %q, wanted %q", response.Actor, "alice")
+	}
+	for _, event := range events {
+		if event.Actor != "alice" {
+			t.Errorf("%s event.Actor => %q, wanted %q", event.State, event.Actor, "alice")
+		}
+	}
+
+	select {
+	case a := <-audits:
+		if a.cmd.Name != Start || a.cmd.Actor != "alice" || a.response.Actor != "alice" || !a.response.Success() {
+			t.Errorf("OnCommand(%+v, %+v), wanted the Start command by alice and its response", a.cmd, a.response)
+		}
+	default:
+		t.Errorf("OnCommand not called")
+	}
 }
@@ -0,0 +1,102 @@
+//go:build unix
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	svc, _ := NewService([]string{"sh", "-c", fmt.Sprintf("sleep 30 & echo $! > %s; wait", pidFile)})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.StopSignal = syscall.SIGTERM
+	svc.ProcessGroup = true
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	if _, err := fmt.Sscan(string(data), &pid); err != nil {
+		t.Fatal(err)
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	h.response()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		state, err := processState(pid)
+		if err != nil || state == 'Z' {
+			break
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild %d still running after stop", pid)
+		}
+	}
+}
+
+func TestExecWrapper(t *testing.T) {
+	svc, _ := NewService([]string{"sh", "-c", "exec sleep 10"})
+	svc.StartTimeout = 200 * time.Millisecond
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	pid := svc.Pid()
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		if string(comm) != "sleep\n" {
+			t.Errorf("/proc/%d/comm => %q, wanted the exec'd sleep", pid, comm)
+		}
+	}
+
+	h.send(Stop)
+	h.expect(Stopping, Stopped)
+	if response := h.response(); !response.Success() || response.Forced {
+		t.Errorf("response => Success() %t, Forced %t, wanted true, false", response.Success(), response.Forced)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("process %d is still alive after Stopped", pid)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	svc, _ := NewService([]string{"sleep", "10"})
+	svc.StartTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := &harness{t, svc, make(chan Command), make(chan Response, 1), make(chan Event)}
+	go svc.RunContext(ctx, h.commands, h.events)
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+	pid := svc.Pid()
+
+	cancel()
+	h.expect(Stopping, Stopped)
+	select {
+	case <-svc.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("RunContext did not return after cancel")
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("kill(%d, 0) => %v after cancel, wanted %v", pid, err, syscall.ESRCH)
+	}
+}
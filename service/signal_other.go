@@ -0,0 +1,13 @@
+//go:build !unix
+
+package service
+
+import "syscall"
+
+// Signal defaults. There is no reload signal to send by default, so Reload
+// fails unless ReloadSignal is set.
+const (
+	DefaultStopSignal   = syscall.SIGINT
+	DefaultReloadSignal = syscall.Signal(0)
+	DefaultKillSignal   = syscall.SIGKILL
+)
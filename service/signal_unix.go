@@ -0,0 +1,12 @@
+//go:build unix
+
+package service
+
+import "syscall"
+
+// Signal defaults.
+const (
+	DefaultStopSignal   = syscall.SIGINT
+	DefaultReloadSignal = syscall.SIGHUP
+	DefaultKillSignal   = syscall.SIGKILL
+)
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrSupervisorShutdown is returned by a Supervisor after Shutdown.
+var ErrSupervisorShutdown = errors.New("supervisor is shut down")
+
+// SupervisorEvent is an Event from one of a Supervisor's services.
+type SupervisorEvent struct {
+	Name string // The name the service was added with.
+	Event
+}
+
+// supervised is a service run by a Supervisor.
+type supervised struct {
+	name     string
+	service  *Service
+	commands chan<- Command
+}
+
+// Supervisor runs multiple named services and combines their events.
+type Supervisor struct {
+	services  map[string]*supervised // The services by name.
+	names     map[*Service]string    // The names of the services.
+	depends   map[string][]string    // The dependencies of services by name.
+	runEvents chan Event             // Receives the events of all services' Runs.
+	events    chan SupervisorEvent   // Receives the events of all services tagged with their names.
+	forwarded chan struct{}          // Closed once all events have been forwarded.
+	shutdown  bool                   // Set once Shutdown has been called.
+	mutex     sync.Mutex             // Protects services, names, depends and shutdown.
+	running   sync.WaitGroup         // Tracks the services' Run goroutines.
+}
+
+// NewSupervisor creates a Supervisor without any services.
+func NewSupervisor() *Supervisor {
+	s := &Supervisor{
+		services:  make(map[string]*supervised),
+		names:     make(map[*Service]string),
+		depends:   make(map[string][]string),
+		runEvents: make(chan Event),
+		events:    make(chan SupervisorEvent),
+		forwarded: make(chan struct{}),
+	}
+	// A single goroutine forwards the events of every service so that they
+	// arrive in the order the services sent them.
+	go func() {
+		defer close(s.forwarded)
+		defer close(s.events)
+		for event := range s.runEvents {
+			s.mutex.Lock()
+			name := s.names[event.Service]
+			s.mutex.Unlock()
+			s.events <- SupervisorEvent{name, event}
+		}
+	}()
+	return s
+}
+
+// Add runs svc under name. The service is not started.
+func (s *Supervisor) Add(name string, svc *Service) error {
+	if svc == nil {
+		return fmt.Errorf("service %s is nil", name)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shutdown {
+		return ErrSupervisorShutdown
+	}
+	if _, ok := s.services[name]; ok {
+		return fmt.Errorf("service %s already exists", name)
+	}
+	if other, ok := s.names[svc]; ok {
+		return fmt.Errorf("service %s is already added as %s", name, other)
+	}
+
+	commands := make(chan Command)
+	s.services[name] = &supervised{name, svc, commands}
+	s.names[svc] = name
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		svc.Run(commands, s.runEvents)
+	}()
+	return nil
+}
+
+// DependsOn makes the service called name depend on the services called
+// deps. StartAll starts dependencies first and waits for them to be Running
+// before starting their dependents, and StopAll and Shutdown stop dependents
+// first. It fails if a service does not exist or the dependency would be
+// circular.
+func (s *Supervisor) DependsOn(name string, deps ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, service := range append([]string{name}, deps...) {
+		if _, ok := s.services[service]; !ok {
+			return fmt.Errorf("service %s does not exist", service)
+		}
+	}
+
+	depends := append(s.depends[name], deps...)
+	previous, ok := s.depends[name]
+	s.depends[name] = depends
+	if _, err := s.levels(); err != nil {
+		if ok {
+			s.depends[name] = previous
+		} else {
+			delete(s.depends, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Event returns the channel on which the events of all services are sent.
+// Events are sent without buffering, so the caller must keep receiving them
+// until the channel is closed by Shutdown.
+func (s *Supervisor) Event() <-chan SupervisorEvent {
+	return s.events
+}
+
+// StartAll starts every service and waits for them to be Running. Services
+// are started in dependency order and a failure leaves the dependents of the
+// failed services stopped.
+func (s *Supervisor) StartAll() error {
+	levels, err := s.list(false)
+	if err != nil {
+		return err
+	}
+	for _, services := range levels {
+		if err := sendAll(services, Start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StopAll stops every service which is Starting, Running or in Backoff,
+// dependents first, and waits for them to be Stopped. Other services are
+// skipped.
+func (s *Supervisor) StopAll() error {
+	levels, err := s.list(false)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := len(levels) - 1; i >= 0; i-- {
+		errs = append(errs, sendAll(activeServices(levels[i]), Stop))
+	}
+	return errors.Join(errs...)
+}
+
+// activeServices returns the services which are Starting, Running or in
+// Backoff.
+func activeServices(services []*supervised) []*supervised {
+	var active []*supervised
+	for _, svc := range services {
+		if state := svc.service.State(); state == Starting || state == Running || state == Backoff {
+			active = append(active, svc)
+		}
+	}
+	return active
+}
+
+// Shutdown shuts down every service, dependents first, waits for them to
+// reach a terminal state and closes the Event channel. No services may be
+// added afterwards.
+func (s *Supervisor) Shutdown() error {
+	levels, err := s.list(true)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := len(levels) - 1; i >= 0; i-- {
+		errs = append(errs, sendAll(levels[i], Shutdown))
+	}
+	s.running.Wait()
+	close(s.runEvents)
+	<-s.forwarded
+	return errors.Join(errs...)
+}
+
+// list returns the services grouped into dependency levels, marking the
+// supervisor shut down if shutdown is set. It fails if the supervisor is
+// already shut down.
+func (s *Supervisor) list(shutdown bool) ([][]*supervised, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shutdown {
+		return nil, ErrSupervisorShutdown
+	}
+	s.shutdown = shutdown
+	return s.levels()
+}
+
+// levels groups the services so that each only depends on services in
+// earlier levels. Each level is sorted by name. It fails if the dependencies
+// are circular. Must be called with mutex held.
+func (s *Supervisor) levels() ([][]*supervised, error) {
+	level := make(map[string]int, len(s.services))
+	visiting := make(map[string]bool)
+	var visit func(name string) (int, error)
+	visit = func(name string) (int, error) {
+		if l, ok := level[name]; ok {
+			return l, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf("circular dependency on service %s", name)
+		}
+		visiting[name] = true
+		l := 0
+		for _, dep := range s.depends[name] {
+			depLevel, err := visit(dep)
+			if err != nil {
+				return 0, err
+			}
+			if depLevel+1 > l {
+				l = depLevel + 1
+			}
+		}
+		visiting[name] = false
+		level[name] = l
+		return l, nil
+	}
+
+	var levels [][]*supervised
+	for name, svc := range s.services {
+		l, err := visit(name)
+		if err != nil {
+			return nil, err
+		}
+		for len(levels) <= l {
+			levels = append(levels, nil)
+		}
+		levels[l] = append(levels[l], svc)
+	}
+	for _, services := range levels {
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].name < services[j].name
+		})
+	}
+	return levels, nil
+}
+
+// sendAll sends a command to every service and waits for their responses.
+// The errors of failed commands are joined in name order.
+func sendAll(services []*supervised, name CommandName) error {
+	responses := make(chan Response, len(services))
+	for _, svc := range services {
+		svc.commands <- Command{Name: name, Response: responses}
+	}
+
+	failed := make(map[*Service]error, len(services))
+	for range services {
+		if response := <-responses; !response.Success() {
+			failed[response.Service] = response.Error
+		}
+	}
+
+	var errs []error
+	for _, svc := range services {
+		if err, ok := failed[svc.service]; ok {
+			errs = append(errs, fmt.Errorf("%s: %w", svc.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	sup := NewSupervisor()
+	for i, name := range []string{"api", "worker"} {
+		svc, _ := NewService([]string{name})
+		svc.StartTimeout = 10 * time.Millisecond
+		svc.CommandFactory = fakeFactory(newFakeRunner(100 + i))
+		if err := sup.Add(name, svc); err != nil {
+			t.Fatalf("sup.Add(%s) => %v, wanted nil", name, err)
+		}
+	}
+	duplicate, _ := NewService([]string{"api"})
+	if err := sup.Add("api", duplicate); err == nil {
+		t.Errorf("sup.Add(api) => nil for a duplicate name, wanted an error")
+	}
+	if err := sup.Add("nil", nil); err == nil {
+		t.Errorf("sup.Add(nil) => nil for a nil service, wanted an error")
+	}
+
+	// Collect the states of each service until Shutdown closes the channel.
+	received := make(map[string][]State)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for event := range sup.Event() {
+			if event.Service == nil || event.Name == "" {
+				t.Errorf("event %+v not tagged with its service", event)
+			}
+			received[event.Name] = append(received[event.Name], event.State)
+		}
+	}()
+
+	if err := sup.StartAll(); err != nil {
+		t.Errorf("sup.StartAll() => %v, wanted nil", err)
+	}
+	if err := sup.StopAll(); err != nil {
+		t.Errorf("sup.StopAll() => %v, wanted nil", err)
+	}
+	if err := sup.Shutdown(); err != nil {
+		t.Errorf("sup.Shutdown() => %v, wanted nil", err)
+	}
+
+	select {
+	case <-collected:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Event channel not closed after Shutdown")
+	}
+	for _, name := range []string{"api", "worker"} {
+		want := []State{Starting, Running, Stopping, Stopped}
+		if got := received[name]; len(got) != len(want) {
+			t.Errorf("%s states => %v, wanted %v", name, got, want)
+			continue
+		}
+		for i := range want {
+			if received[name][i] != want[i] {
+				t.Errorf("%s states => %v, wanted %v", name, received[name], want)
+				break
+			}
+		}
+	}
+
+	if err := sup.StartAll(); err != ErrSupervisorShutdown {
+		t.Errorf("sup.StartAll() after Shutdown => %v, wanted %v", err, ErrSupervisorShutdown)
+	}
+}
+
+// superviseAll adds a service for each name to a new Supervisor and collects
+// its events until the Event channel is closed.
+func superviseAll(t *testing.T, names ...string) (*Supervisor, func() []SupervisorEvent) {
+	sup := NewSupervisor()
+	for i, name := range names {
+		svc, _ := NewService([]string{name})
+		svc.StartTimeout = 10 * time.Millisecond
+		svc.CommandFactory = fakeFactory(newFakeRunner(100 + i))
+		if err := sup.Add(name, svc); err != nil {
+			t.Fatalf("sup.Add(%s) => %v, wanted nil", name, err)
+		}
+	}
+
+	var events []SupervisorEvent
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for event := range sup.Event() {
+			events = append(events, event)
+		}
+	}()
+	return sup, func() []SupervisorEvent {
+		select {
+		case <-collected:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Event channel not closed after Shutdown")
+		}
+		return events
+	}
+}
+
+// indexOf returns the position of the event for name entering state.
+func indexOf(events []SupervisorEvent, name string, state State) int {
+	for i, event := range events {
+		if event.Name == name && event.State == state {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSupervisorDependsOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		depends map[string][]string
+	}{
+		{"chain", map[string][]string{"b": {"a"}, "c": {"b"}}},
+		{"diamond", map[string][]string{"b": {"a"}, "c": {"a"}, "d": {"b", "c"}}},
+	}
+	for _, test := range tests {
+		sup, collect := superviseAll(t, "a", "b", "c", "d")
+		for name, deps := range test.depends {
+			if err := sup.DependsOn(name, deps...); err != nil {
+				t.Fatalf("%s: sup.DependsOn(%s, %v) => %v, wanted nil", test.name, name, deps, err)
+			}
+		}
+		if err := sup.StartAll(); err != nil {
+			t.Errorf("%s: sup.StartAll() => %v, wanted nil", test.name, err)
+		}
+		if err := sup.StopAll(); err != nil {
+			t.Errorf("%s: sup.StopAll() => %v, wanted nil", test.name, err)
+		}
+		sup.Shutdown()
+		events := collect()
+
+		for name, deps := range test.depends {
+			for _, dep := range deps {
+				running, starting := indexOf(events, dep, Running), indexOf(events, name, Starting)
+				if running < 0 || starting < 0 || running > starting {
+					t.Errorf("%s: %s started before its dependency %s was Running", test.name, name, dep)
+				}
+				stopped, stopping := indexOf(events, name, Stopped), indexOf(events, dep, Stopping)
+				if stopped < 0 || stopping < 0 || stopped > stopping {
+					t.Errorf("%s: %s stopped before its dependent %s was Stopped", test.name, dep, name)
+				}
+			}
+		}
+	}
+}
+
+func TestSupervisorCircularDependency(t *testing.T) {
+	sup, collect := superviseAll(t, "a", "b", "c")
+	defer collect()
+	defer sup.Shutdown()
+
+	if err := sup.DependsOn("b", "a"); err != nil {
+		t.Fatalf("sup.DependsOn(b, a) => %v, wanted nil", err)
+	}
+	if err := sup.DependsOn("c", "b"); err != nil {
+		t.Fatalf("sup.DependsOn(c, b) => %v, wanted nil", err)
+	}
+	if err := sup.DependsOn("a", "c"); err == nil {
+		t.Errorf("sup.DependsOn(a, c) => nil, wanted a circular dependency error")
+	}
+	if err := sup.DependsOn("a", "missing"); err == nil {
+		t.Errorf("sup.DependsOn(a, missing) => nil, wanted an error")
+	}
+	if err := sup.StartAll(); err != nil {
+		t.Errorf("sup.StartAll() => %v after rejecting the cycle, wanted nil", err)
+	}
+}
+
+func TestSupervisorStopAllSkipsStopped(t *testing.T) {
+	sup, collect := superviseAll(t, "api", "worker")
+	defer collect()
+	defer sup.Shutdown()
+
+	if err := sup.StopAll(); err != nil {
+		t.Errorf("sup.StopAll() => %v with no service running, wanted nil", err)
+	}
+	if err := sup.StartAll(); err != nil {
+		t.Fatalf("sup.StartAll() => %v, wanted nil", err)
+	}
+	if err := sup.StopAll(); err != nil {
+		t.Errorf("sup.StopAll() => %v, wanted nil", err)
+	}
+	if err := sup.StopAll(); err != nil {
+		t.Errorf("sup.StopAll() => %v after the services stopped, wanted nil", err)
+	}
+}
+
+func TestSupervisorStopAllBackoff(t *testing.T) {
+	failure := errors.New("exit status 1")
+	first, crash := newFakeRunner(100), newFakeRunner(101)
+	crash.Exit(failure)
+	svc, _ := NewService([]string{"worker"})
+	svc.StartTimeout = 10 * time.Millisecond
+	svc.BackoffInitial = time.Minute
+	svc.CommandFactory = fakeFactory(first, crash)
+
+	sup := NewSupervisor()
+	if err := sup.Add("worker", svc); err != nil {
+		t.Fatalf("sup.Add(worker) => %v, wanted nil", err)
+	}
+	backoff := make(chan struct{})
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for event := range sup.Event() {
+			if event.State == Backoff {
+				close(backoff)
+			}
+		}
+	}()
+	defer func() { <-collected }()
+	defer sup.Shutdown()
+
+	if err := sup.StartAll(); err != nil {
+		t.Fatalf("sup.StartAll() => %v, wanted nil", err)
+	}
+	// The process crashes and then fails to start again.
+	first.Exit(failure)
+	select {
+	case <-backoff:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for Backoff")
+	}
+	if err := sup.StopAll(); err != nil {
+		t.Errorf("sup.StopAll() => %v, wanted nil", err)
+	}
+	if state := svc.State(); state != Stopped {
+		t.Errorf("svc.State() => %s after StopAll, wanted %s", state, Stopped)
+	}
+}
@@ -0,0 +1,78 @@
+//go:build unix
+
+package service
+
+import (
+	"bytes"
+	"log/syslog"
+	"sync"
+)
+
+// syslogMaxLine is the longest partial line held by a SyslogWriter. Longer
+// lines are split into messages of this length.
+const syslogMaxLine = 4096
+
+// SyslogWriter forwards process output to syslog with one message per line.
+// Assign it to a Service's Stdout or Stderr.
+type SyslogWriter struct {
+	OnError func(err error) // When set, called with each error from sending a message to syslog. Called from Write, so it must not block.
+	writer  *syslog.Writer
+	buffer  []byte
+	mutex   sync.Mutex
+}
+
+// NewSyslogWriter connects to the syslog daemon at raddr on network. An empty
+// network and raddr connect to the local syslog daemon. Lines are logged with
+// the facility and severity in priority and tagged with tag.
+func NewSyslogWriter(network, raddr string, priority syslog.Priority, tag string) (*SyslogWriter, error) {
+	writer, err := syslog.Dial(network, raddr, priority, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogWriter{writer: writer}, nil
+}
+
+// Write logs each complete line in p. A trailing partial line is held until
+// its newline arrives, or is logged once it reaches 4096 bytes. Write never
+// fails: the syslog connection is retried on the next line and undeliverable
+// lines are passed to OnError and dropped so that a syslog outage does not
+// block or break the process's output.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer = append(w.buffer, p...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			if len(w.buffer) < syslogMaxLine {
+				break
+			}
+			w.send(w.buffer[:syslogMaxLine])
+			w.buffer = w.buffer[syslogMaxLine:]
+			continue
+		}
+		w.send(w.buffer[:i])
+		w.buffer = w.buffer[i+1:]
+	}
+	return len(p), nil
+}
+
+// send logs a message, passing any error to OnError.
+func (w *SyslogWriter) send(message []byte) {
+	if _, err := w.writer.Write(message); err != nil && w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+// Close logs any partial line and closes the syslog connection.
+func (w *SyslogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.buffer) > 0 {
+		w.send(w.buffer)
+		w.buffer = nil
+	}
+	return w.writer.Close()
+}
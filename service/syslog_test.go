@@ -0,0 +1,111 @@
+//go:build unix
+
+package service
+
+import (
+	"log/syslog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	writer, err := NewSyslogWriter("unixgram", addr, syslog.LOG_LOCAL0|syslog.LOG_NOTICE, "myservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	svc, _ := NewService([]string{"sh", "-c", "echo hello; printf 'wor'; printf 'ld\n'; sleep 1"})
+	svc.StartTimeout = 100 * time.Millisecond
+	svc.Stdout = writer
+
+	h := run(t, svc)
+	defer h.shutdown()
+	h.send(Start)
+	h.expect(Starting, Running)
+	h.response()
+
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"hello", "world"} {
+		n, err := listener.Read(buffer)
+		if err != nil {
+			t.Fatalf("reading syslog message for %q: %s", line, err)
+		}
+		message := string(buffer[:n])
+		if !strings.HasPrefix(message, "<133>") {
+			t.Errorf("syslog message %q has wrong priority, wanted <133>", message)
+		}
+		if !strings.Contains(message, " myservice[") {
+			t.Errorf("syslog message %q is missing tag myservice", message)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(message), ": "+line) {
+			t.Errorf("syslog message %q, wanted line %q", message, line)
+		}
+	}
+}
+
+func TestSyslogWriterLongLine(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	writer, err := NewSyslogWriter("unixgram", addr, syslog.LOG_LOCAL0|syslog.LOG_NOTICE, "myservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	writer.Write([]byte(strings.Repeat("x", syslogMaxLine+10)))
+	if n := len(writer.buffer); n != 10 {
+		t.Errorf("writer holds %d bytes of a long line, wanted 10", n)
+	}
+	buffer := make([]byte, 2*syslogMaxLine)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := listener.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message := strings.TrimSpace(string(buffer[:n])); !strings.HasSuffix(message, ": "+strings.Repeat("x", syslogMaxLine)) {
+		t.Errorf("syslog message of %d bytes, wanted the first %d bytes of the line", len(message), syslogMaxLine)
+	}
+}
+
+func TestSyslogWriterError(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewSyslogWriter("unixgram", addr, syslog.LOG_LOCAL0|syslog.LOG_NOTICE, "myservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	var errs []error
+	writer.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	listener.Close()
+	if n, err := writer.Write([]byte("lost\n")); n != 5 || err != nil {
+		t.Errorf("writer.Write() => %d, %v, wanted 5, nil", n, err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("OnError called %d times, wanted 1", len(errs))
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !unix
+
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// errProcessGroup is returned when ProcessGroup is set on a platform without
+// process groups.
+var errProcessGroup = errors.New("process groups are not supported on this platform")
+
+// transientErrnos are the errors starting a process which may succeed if
+// tried again.
+var transientErrnos = []syscall.Errno{syscall.EAGAIN, syscall.EINTR, syscall.ENOMEM, syscall.EMFILE, syscall.ENFILE}
+
+// setProcessGroup is not supported without process groups.
+func setProcessGroup(cmd *exec.Cmd) error {
+	return errProcessGroup
+}
+
+// signalGroup is not supported without process groups.
+func signalGroup(pid int, sig os.Signal) error {
+	return errProcessGroup
+}
+
+// setCredential is not supported without process credentials.
+func setCredential(cmd *exec.Cmd, cred *Credential) error {
+	return errors.New("credentials are not supported on this platform")
+}
+
+// closeOnExec is not supported without /dev/fd.
+func closeOnExec() error {
+	return errors.New("close-on-exec is not supported on this platform")
+}
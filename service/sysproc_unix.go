@@ -0,0 +1,66 @@
+//go:build unix
+
+package service
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// transientErrnos are the errors starting a process which may succeed if
+// tried again.
+var transientErrnos = []syscall.Errno{syscall.ETXTBSY, syscall.EAGAIN, syscall.EINTR, syscall.ENOMEM, syscall.EMFILE, syscall.ENFILE}
+
+// setProcessGroup makes the command run in a new process group led by the
+// process.
+func setProcessGroup(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return nil
+}
+
+// signalGroup sends a signal to every process in the group led by pid.
+func signalGroup(pid int, sig os.Signal) error {
+	signal, ok := sig.(syscall.Signal)
+	if !ok {
+		return os.ErrInvalid
+	}
+	return syscall.Kill(-pid, signal)
+}
+
+// setCredential makes the command run as the user and groups in cred.
+func setCredential(cmd *exec.Cmd, cred *Credential) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    cred.Uid,
+		Gid:    cred.Gid,
+		Groups: cred.Groups,
+	}
+	return nil
+}
+
+// closeOnExec marks every open descriptor other than stdio close-on-exec so
+// that none are inherited by processes started afterwards.
+func closeOnExec() error {
+	dir, err := os.Open("/dev/fd")
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if fd, err := strconv.Atoi(name); err == nil && fd > 2 {
+			syscall.CloseOnExec(fd)
+		}
+	}
+	return nil
+}